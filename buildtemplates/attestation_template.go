@@ -0,0 +1,114 @@
+package buildtemplates
+
+// AttestationDockerTemplate builds GrapheneOS' AttestationServer, the server side
+// of the Auditor app, at the commit pinned by attestation-commit
+const AttestationDockerTemplate = `FROM ubuntu:20.04
+
+ENV DEBIAN_FRONTEND=noninteractive
+
+RUN apt-get update && \
+    apt-get -y install ca-certificates git openjdk-11-jdk-headless sqlite3 && \
+    apt-get clean && rm -rf /var/lib/apt/lists/* /tmp/* /var/tmp/*
+
+ARG ATTESTATION_COMMIT=<% .AttestationCommit %>
+
+RUN git init /attestation && \
+    git -C /attestation fetch --depth 1 https://github.com/GrapheneOS/AttestationServer.git "${ATTESTATION_COMMIT}" && \
+    git -C /attestation checkout --detach FETCH_HEAD && \
+    test "$(git -C /attestation rev-parse HEAD)" = "${ATTESTATION_COMMIT}"
+
+WORKDIR /attestation
+
+# the server only listens on localhost as it normally sits behind nginx
+RUN sed -i 's@new InetSocketAddress("localhost", 8080)@new InetSocketAddress("0.0.0.0", 8080)@' \
+      src/main/java/app/attestation/server/AttestationServer.java && \
+    grep -q 'new InetSocketAddress("0.0.0.0", 8080)' src/main/java/app/attestation/server/AttestationServer.java
+
+# the entrypoint adds the verified boot key to the builder of
+# fingerprintsCustomOS, fail now if this commit doesn't have it
+RUN sed -n '/fingerprintsCustomOS = ImmutableMap/,/builder()/p' \
+      src/main/java/app/attestation/server/AttestationProtocol.java | grep -q 'builder()'
+
+# warm the gradle cache so starting the container does not download the world
+RUN ./gradlew --no-daemon build -x test
+
+COPY entrypoint.sh /entrypoint.sh
+
+RUN mkdir -p /data /keys
+
+VOLUME ["/data"]
+
+EXPOSE 8080
+
+ENTRYPOINT ["/bin/bash", "/entrypoint.sh"]
+`
+
+// AttestationEntrypoint pins the verified boot keys of every profile to the
+// server before starting it. The keys only exist after the first build, so
+// this has to happen when the container starts rather than in the image.
+// KEY_SETS lists the keys volumes mounted below /keys as <n>/<device>.
+const AttestationEntrypoint = `
+#!/bin/bash
+
+set -e
+
+PROTOCOL="/attestation/src/main/java/app/attestation/server/AttestationProtocol.java"
+PINNED="/attestation/.pinned-keys"
+
+device_info() {
+  case "$1" in
+<% range .SupportedDevices %>  <% .Codename %>)
+    echo "<% .AttestationName %> <% .AttestationVersion %> <% .KeymasterVersion %>"
+    ;;
+<% end %>  *)
+    echo "error: unknown device $1" >&2
+    return 1
+    ;;
+  esac
+}
+
+pinned=""
+for set in ${KEY_SETS}; do
+  device="${set#*/}"
+  info=$(device_info "${device}")
+  pkmd="/keys/${set}/avb_pkmd.bin"
+
+  if [ ! -f "${pkmd}" ]; then
+    echo "warning: ${pkmd} does not exist, build ${device} to generate its keys and deploy again"
+    continue
+  fi
+
+  fingerprint=$(sha256sum "${pkmd}" | awk '{print toupper($1)}')
+  echo "verified boot key fingerprint for ${device}: ${fingerprint}"
+
+  # profiles can share a key, the map only takes it once
+  if ! grep -q "^${fingerprint} " <<< "${pinned}"; then
+    pinned="${pinned}${fingerprint} ${info}"$'\n'
+  fi
+done
+
+if [ -z "${pinned}" ]; then
+  echo "error: no verified boot keys, run localstack build to generate keys first"
+  exit 1
+fi
+
+cd /attestation
+
+if [ "${pinned}" != "$(cat "${PINNED}" 2>/dev/null)"$'\n' ]; then
+  git checkout -- "${PROTOCOL}"
+  while read -r fingerprint device_name attestation_version keymaster_version; do
+    [ -n "${fingerprint}" ] || continue
+    sed -i "/fingerprintsCustomOS = ImmutableMap/,/builder()/ s@builder()@builder()\n            .put(\"${fingerprint}\",\n                    new DeviceInfo(${device_name}, ${attestation_version}, ${keymaster_version}, false, true, \"RattlesnakeOS\"))@" "${PROTOCOL}"
+    if ! grep -q "${fingerprint}" "${PROTOCOL}"; then
+      echo "error: failed to add the verified boot key to ${PROTOCOL}"
+      exit 1
+    fi
+  done <<< "${pinned}"
+  ./gradlew --no-daemon build -x test
+  printf '%s' "${pinned}" > "${PINNED}"
+fi
+
+# the databases live in the working directory
+cd /data
+exec java -cp "/attestation/build/libs/*" app.attestation.server.AttestationServer
+`
@@ -12,33 +12,12 @@ fi
 # check if supported device
 DEVICE=$1
 case "${DEVICE}" in
-  taimen)
-    DEVICE_FAMILY=taimen
-    AVB_MODE=vbmeta_simple
+<% range .SupportedDevices %>  <% .Codename %>)
+    DEVICE_FAMILY=<% .Family %>
+    AVB_MODE=<% .AVBMode %>
+    EXTRA_OTA=(<% .ExtraOTAArgs %>)
     ;;
-  walleye)
-    DEVICE_FAMILY=muskie
-    AVB_MODE=vbmeta_simple
-    ;;
-  crosshatch|blueline)
-    DEVICE_FAMILY=crosshatch
-    AVB_MODE=vbmeta_chained
-    EXTRA_OTA=(--retrofit_dynamic_partitions)
-    ;;
-  sargo|bonito)
-    DEVICE_FAMILY=bonito
-    AVB_MODE=vbmeta_chained
-    EXTRA_OTA=(--retrofit_dynamic_partitions)
-    ;;
-  flame|coral)
-    DEVICE_FAMILY=coral
-    AVB_MODE=vbmeta_chained_v2
-    ;;
-  sunfish)
-    DEVICE_FAMILY=sunfish
-    AVB_MODE=vbmeta_chained_v2
-    ;;
-  *)
+<% end %>  *)
     echo "error: unknown device ${DEVICE}"
     exit 1
     ;;
@@ -56,6 +35,26 @@ AOSP_BUILD=$3
 AOSP_BRANCH=$4
 AOSP_VENDOR_BUILD=
 
+# resume a failed build or run specific steps, passed in the environment
+RESUME_BUILD=${RESUME_BUILD:-false}
+FROM_STEP=${FROM_STEP:-}
+ONLY_STEP=${ONLY_STEP:-}
+KEYS_ONLY=${KEYS_ONLY:-false}
+
+# localstack keys rotate signs the build with new keys, see finish_key_rotation
+ROTATE_KEYS=${ROTATE_KEYS:-false}
+ROTATE_AVB=${ROTATE_AVB:-false}
+SIGNING_KEYS="${DEVICE}"
+if [ "${ROTATE_KEYS}" = true ]; then
+  echo "Rotating keys, setting FORCE_BUILD=true"
+  SIGNING_KEYS="${DEVICE}.new"
+  FORCE_BUILD=true
+fi
+if [ "${RESUME_BUILD}" = true ] || [ -n "${FROM_STEP}" ] || [ -n "${ONLY_STEP}" ]; then
+  echo "Resuming build (FROM_STEP=${FROM_STEP} ONLY_STEP=${ONLY_STEP}), setting FORCE_BUILD=true"
+  FORCE_BUILD=true
+fi
+
 # set region
 REGION=us-east-1
 export AWS_DEFAULT_REGION=${REGION}
@@ -72,11 +71,12 @@ CHROMIUM_PINNED_VERSION=<% .ChromiumVersion %>
 # pin to specific version of android
 ANDROID_VERSION="11.0"
 
-# build type (user or userdebug)
-BUILD_TYPE="user"
+# build type (user, userdebug or eng), set by localstack build --variant, the
+# profile or the variant config key
+BUILD_TYPE="${BUILD_TYPE:-user}"
 
-# build channel (stable or beta)
-BUILD_CHANNEL="dev"
+# build channel (dev, beta or stable), set by localstack build --channel or the profile
+BUILD_CHANNEL="${BUILD_CHANNEL:-dev}"
 
 # user customizable things
 HOSTS_FILE=<% .HostsFile %>
@@ -88,18 +88,64 @@ AWS_KEYS_BUCKET="/keys"
 AWS_RELEASE_BUCKET="/release"
 AWS_LOGS_BUCKET="/logs"
 
+# localstack writes secrets to files in this in memory filesystem, they are
+# never passed in the environment
+SECRETS_DIR="/run/localstack"
+
+# seal private keys in the keys volume with the passphrase in
+# KEYS_PASSPHRASE_FILE. they are only unsealed into the in memory KEYS_DIR while
+# signing
+ENCRYPTED_KEYS=<% .EncryptedKeys %>
+KEYS_PASSPHRASE_FILE="${SECRETS_DIR}/keys-passphrase"
+
+# named stack profiles keep their version checkpoints, chromium and target
+# files apart, only the OTA files are published to the shared release directory
+PROFILE=${PROFILE:-}
+STATE_BUCKET="${AWS_RELEASE_BUCKET}"
+if [ -n "${PROFILE}" ]; then
+  STATE_BUCKET="${AWS_RELEASE_BUCKET}/profiles/${PROFILE}"
+fi
+
+# debug variants keep their own checkpoints and target files, and publish to a
+# subdirectory of the release directory that only their own Updater app looks
+# at, so devices running user builds are never offered a debug build
+VARIANT_DIR=""
+RELEASE_BUCKET="${AWS_RELEASE_BUCKET}"
+if [ "${BUILD_TYPE}" != "user" ]; then
+  VARIANT_DIR="${BUILD_TYPE}/"
+  STATE_BUCKET="${STATE_BUCKET}/variants/${BUILD_TYPE}"
+  RELEASE_BUCKET="${AWS_RELEASE_BUCKET}/${BUILD_TYPE}"
+fi
+
 # build settings
 SECONDS=0
 BUILD_TARGET="release aosp_${DEVICE} ${BUILD_TYPE}"
-RELEASE_URL="https://ota.ballmerlabs.net" #TODO: template this
+RELEASE_URL="<% .ReleaseURL %>"
 RELEASE_CHANNEL="${DEVICE}-${BUILD_CHANNEL}"
+# each channel keeps the target files of its last release, incremental OTAs are
+# made against the build the devices on that channel run
+TARGET_FILES_DIR="${STATE_BUCKET}/${RELEASE_CHANNEL}-target"
 BUILD_DATE=$(date +%Y.%m.%d.%H)
 BUILD_TIMESTAMP=$(date +%s)
 BUILD_DIR="/build/build"
+# parallel jobs, matches the cpu limit of the build container
+NPROC=<% .NumProc %>
+if [ "${NPROC}" -lt 1 ]; then
+  NPROC=$(nproc)
+fi
 KEYS_DIR="${BUILD_DIR}/keys"
-CERTIFICATE_SUBJECT='/CN=RattlesnakeOS'
+CHECKPOINT_DIR="/build/checkpoints"
+CERTIFICATE_SUBJECT='<% .Keys.Subject %>'
+KEY_RSA_SIZE=<% .Keys.RSASize %>
+AVB_KEY_RSA_SIZE=<% .Keys.AVBRSASize %>
+KEY_VALIDITY_DAYS=<% .Keys.Validity %>
+# the keystore password is never written to the script, passed on a command
+# line or kept in the environment, the tools signing with it read it from
+# KEYSTORE_PASSWORD_FILE
+KEYSTORE_PASSWORD_FILE="${SECRETS_DIR}/keystore-password"
 OFFICIAL_FDROID_KEY="43238d512c1e5eb2d6569f4a3afbf5523418b82e0a3ed1552770abb9a9c9ccab"
 BUILD_REASON=""
+FAILURE_REASON=""
 
 # urls
 MANIFEST_URL="https://android.googlesource.com/platform/manifest"
@@ -117,13 +163,11 @@ LATEST_CHROMIUM=
 FDROID_CLIENT_VERSION=
 FDROID_PRIV_EXT_VERSION=
 
-full_run() {
-  log_header "${FUNCNAME[0]}"
-
+# steps run by full_run in order, keep in sync with stack.BuildSteps
+BUILD_STEPS=(
   get_latest_versions
   check_for_new_versions
   initial_key_setup
-  aws_notify "RattlesnakeOS Build STARTED"
   setup_env
   aws_import_keys
   check_chromium
@@ -138,7 +182,31 @@ full_run() {
   release
   aws_upload
   checkpoint_versions
-  aws_notify "RattlesnakeOS Build SUCCESS"
+  finish_key_rotation
+)
+
+# steps that only set up state for the rest of the build, these always run.
+# keep in sync with stack.SetupSteps
+SETUP_STEPS=" get_latest_versions check_for_new_versions initial_key_setup setup_env aws_import_keys "
+
+full_run() {
+  log_header "${FUNCNAME[0]}"
+
+  # localstack keys generate
+  if [ "${KEYS_ONLY}" == "true" ]; then
+    get_latest_versions
+    initial_key_setup
+    aws_import_keys
+    return
+  fi
+
+  for step in "${BUILD_STEPS[@]}"; do
+    run_step "${step}"
+    if [ "${step}" == "initial_key_setup" ]; then
+      aws_notify "RattlesnakeOS Build STARTED" STARTED
+    fi
+  done
+  aws_notify "RattlesnakeOS Build SUCCESS" SUCCESS
 }
 
 get_latest_versions() {
@@ -179,6 +247,9 @@ get_latest_versions() {
   fi
   log "AOSP_VENDOR_BUILD=${AOSP_VENDOR_BUILD}"
   log "AOSP_BUILD=${AOSP_BUILD}"
+  if [ "${AOSP_BUILD}" != "${AOSP_VENDOR_BUILD}" ]; then
+    log_header "WARNING: requested AOSP build ${AOSP_BUILD} does not match vendor build ${AOSP_VENDOR_BUILD}"
+  fi
 
   if [ -z "${AOSP_BRANCH}" ]; then
     AOSP_BRANCH=$(jq -r ".devices.${DEVICE}.aosp_tag" "${HOME}/latest.json")
@@ -198,7 +269,7 @@ check_for_new_versions() {
   needs_update=false
 
   # check aosp
-  existing_aosp_build=$(sudo -E cat ${AWS_RELEASE_BUCKET}/${DEVICE}-vendor || echo "")
+  existing_aosp_build=$(sudo -E cat ${STATE_BUCKET}/${DEVICE}-vendor || echo "")
   if [ "${existing_aosp_build}" == "${AOSP_VENDOR_BUILD}" ]; then
     log "AOSP build (${existing_aosp_build}) is up to date"
   else
@@ -212,14 +283,14 @@ check_for_new_versions() {
     log "Setting LATEST_CHROMIUM to pinned version ${CHROMIUM_PINNED_VERSION}"
     LATEST_CHROMIUM="${CHROMIUM_PINNED_VERSION}"
   fi
-  existing_chromium=$(sudo -E cat ${AWS_RELEASE_BUCKET}/chromium/revision 2>/dev/null || echo "")
-  chromium_included=$(sudo -E cat ${AWS_RELEASE_BUCKET}/chromium/included 2>/dev/null|| echo "")
+  existing_chromium=$(sudo -E cat ${STATE_BUCKET}/chromium/revision 2>/dev/null || echo "")
+  chromium_included=$(sudo -E cat ${STATE_BUCKET}/chromium/included 2>/dev/null|| echo "")
   if [ "${existing_chromium}" == "${LATEST_CHROMIUM}" ] && [ "${chromium_included}" == "yes" ]; then
     log "Chromium build (${existing_chromium}) is up to date"
   else
     log "Chromium needs to be updated to ${LATEST_CHROMIUM}"
-    sudo -E mkdir -p ${AWS_RELEASE_BUCKET}/chromium
-    sudo -E bash -c "echo 'no' > ${AWS_RELEASE_BUCKET}/chromium/included"
+    sudo -E mkdir -p ${STATE_BUCKET}/chromium
+    sudo -E bash -c "echo 'no' > ${STATE_BUCKET}/chromium/included"
     needs_update=true
     if [ "${existing_chromium}" == "${LATEST_CHROMIUM}" ]; then
       BUILD_REASON="${BUILD_REASON} 'Chromium version ${existing_chromium} built but not installed'"
@@ -229,7 +300,7 @@ check_for_new_versions() {
   fi
 
   # check fdroid
-  existing_fdroid_client=$(sudo -E cat ${AWS_RELEASE_BUCKET}/fdroid/revision 2>/dev/null || echo "")
+  existing_fdroid_client=$(sudo -E cat ${STATE_BUCKET}/fdroid/revision 2>/dev/null || echo "")
   if [ "${existing_fdroid_client}" == "${FDROID_CLIENT_VERSION}" ]; then
     log "F-Droid build (${existing_fdroid_client}) is up to date"
   else
@@ -239,7 +310,7 @@ check_for_new_versions() {
   fi
 
   # check fdroid priv extension
-  existing_fdroid_priv_version=$(sudo -E cat ${AWS_RELEASE_BUCKET}/fdroid-priv/revision 2>/dev/null || echo "")
+  existing_fdroid_priv_version=$(sudo -E cat ${STATE_BUCKET}/fdroid-priv/revision 2>/dev/null || echo "")
   if [ "${existing_fdroid_priv_version}" == "${FDROID_PRIV_EXT_VERSION}" ]; then
     log "F-Droid privileged extension build (${existing_fdroid_priv_version}) is up to date"
   else
@@ -256,7 +327,7 @@ check_for_new_versions() {
       log "${message}"
       BUILD_REASON="${message}"
     else
-      aws_notify "RattlesnakeOS build not required as all components are already up to date."
+      aws_notify "RattlesnakeOS build not required as all components are already up to date." NOT_REQUIRED
       exit 0
     fi
   fi
@@ -270,9 +341,9 @@ add_chromium() {
   log_header "${FUNCNAME[0]}"
 
   # add latest built chromium to external/chromium
-  sudo -E cp ${AWS_RELEASE_BUCKET}/chromium/TrichromeLibrary.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/
-  sudo -E cp ${AWS_RELEASE_BUCKET}/chromium/TrichromeWebView.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/
-  sudo -E cp ${AWS_RELEASE_BUCKET}/chromium/TrichromeChrome.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/
+  sudo -E cp ${STATE_BUCKET}/chromium/TrichromeLibrary.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/
+  sudo -E cp ${STATE_BUCKET}/chromium/TrichromeWebView.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/
+  sudo -E cp ${STATE_BUCKET}/chromium/TrichromeChrome.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/
   sudo -E chown -R build:build ${BUILD_DIR}/external/chromium/prebuilt/arm64/
 
   cat <<EOF > "${BUILD_DIR}/frameworks/base/core/res/res/xml/config_webview_packages.xml"
@@ -336,13 +407,103 @@ get_encryption_key() {
 }
 
 initial_key_setup() {
-  # setup in memory file system to hold keys
-  log "Mounting in memory filesystem at ${KEYS_DIR} to hold keys"
-  mkdir -p "${KEYS_DIR}"
+  if [ "${ENCRYPTED_KEYS}" == "true" ]; then
+    # localstack mounts a tmpfs at KEYS_DIR for encrypted keys
+    log "Using in memory filesystem at ${KEYS_DIR} to hold keys"
+    if ! mountpoint -q "${KEYS_DIR}"; then
+      aws_notify_simple "ERROR: ${KEYS_DIR} is not an in memory filesystem, refusing to unseal keys. Stopping build."
+      exit 1
+    fi
+    if [ ! -s "${KEYS_PASSPHRASE_FILE}" ]; then
+      aws_notify_simple "ERROR: keys are encrypted but no passphrase was given. Stopping build."
+      exit 1
+    fi
+    sudo -E chown build:build "${KEYS_DIR}"
+    chmod 700 "${KEYS_DIR}"
+  else
+    mkdir -p "${KEYS_DIR}"
+  fi
 
   get_encryption_key
 }
 
+# key_sets prints the key sets the build needs, DEVICE and during a key
+# rotation the new keys in DEVICE.new
+key_sets() {
+  echo "${DEVICE}"
+  if [ "${ROTATE_KEYS}" == "true" ]; then
+    echo "${DEVICE}.new"
+  fi
+}
+
+# sealed_keys [key set] prints the path of the encrypted key archive
+sealed_keys() {
+  echo "${AWS_KEYS_BUCKET}/${1:-${DEVICE}}.tar.gpg"
+}
+
+# seal_keys [key set] encrypts the keys in KEYS_DIR into the keys volume, only
+# the certificates and the avb public key are left readable next to it
+seal_keys() {
+  local keyset="${1:-${DEVICE}}"
+  log "Sealing keys ${keyset}"
+
+  tar -C "${KEYS_DIR}/${keyset}" -cf "${KEYS_DIR}/${keyset}.tar" .
+  gpg --batch --yes --quiet --pinentry-mode loopback --passphrase-file "${KEYS_PASSPHRASE_FILE}" --symmetric \
+      --cipher-algo AES256 --output "${KEYS_DIR}/${keyset}.tar.gpg" "${KEYS_DIR}/${keyset}.tar"
+  rm -f "${KEYS_DIR}/${keyset}.tar"
+  sudo -E cp "${KEYS_DIR}/${keyset}.tar.gpg" "$(sealed_keys "${keyset}")"
+  rm -f "${KEYS_DIR}/${keyset}.tar.gpg"
+
+  sudo -E rm -rf "${AWS_KEYS_BUCKET}/${keyset}"
+  sudo -E mkdir -p "${AWS_KEYS_BUCKET}/${keyset}"
+  sudo -E rsync -avz --include '*.x509.pem' --include 'avb_pkmd.bin' --exclude '*' "${KEYS_DIR}/${keyset}/" "${AWS_KEYS_BUCKET}/${keyset}"
+}
+
+# unseal_key_set <key set> decrypts a single key set into KEYS_DIR
+unseal_key_set() {
+  local keyset="$1"
+  log "Unsealing keys ${keyset}"
+
+  sudo -E cat "$(sealed_keys "${keyset}")" > "${KEYS_DIR}/${keyset}.tar.gpg"
+  if ! gpg --batch --yes --quiet --pinentry-mode loopback --passphrase-file "${KEYS_PASSPHRASE_FILE}" --decrypt \
+      --output "${KEYS_DIR}/${keyset}.tar" "${KEYS_DIR}/${keyset}.tar.gpg"; then
+    rm -f "${KEYS_DIR}/${keyset}.tar.gpg"
+    aws_notify_simple "ERROR: unable to unseal keys ${keyset}, wrong passphrase?"
+    exit 1
+  fi
+  rm -f "${KEYS_DIR}/${keyset}.tar.gpg"
+  mkdir -p "${KEYS_DIR}/${keyset}"
+  tar -C "${KEYS_DIR}/${keyset}" -xf "${KEYS_DIR}/${keyset}.tar"
+  rm -f "${KEYS_DIR}/${keyset}.tar"
+}
+
+# unseal_keys decrypts the keys the build needs into KEYS_DIR, a no-op for
+# plain keys
+unseal_keys() {
+  if [ "${ENCRYPTED_KEYS}" != "true" ]; then
+    return
+  fi
+
+  local keyset
+  for keyset in $(key_sets); do
+    unseal_key_set "${keyset}"
+  done
+}
+
+# wipe_keys removes the private keys from KEYS_DIR again, a no-op for plain keys
+wipe_keys() {
+  if [ "${ENCRYPTED_KEYS}" != "true" ]; then
+    return
+  fi
+
+  local keyset
+  for keyset in $(key_sets); do
+    log "Wiping unsealed keys ${keyset}"
+    rm -f "${KEYS_DIR}/${keyset}"/*.pk8 "${KEYS_DIR}/${keyset}/avb.pem" "${KEYS_DIR}/${keyset}/chromium.keystore" \
+        "${KEYS_DIR}/${keyset}.tar" "${KEYS_DIR}/${keyset}.tar.gpg"
+  done
+}
+
 setup_env() {
   log_header "${FUNCNAME[0]}"
 
@@ -357,7 +518,7 @@ setup_env() {
 check_chromium() {
   log_header "${FUNCNAME[0]}"
 
-  current=$(sudo -E cat ${AWS_RELEASE_BUCKET}/chromium/revision 2>/dev/null || echo "")
+  current=$(sudo -E cat ${STATE_BUCKET}/chromium/revision 2>/dev/null || echo "")
   log "Chromium current: ${current}"
 
   log "Chromium latest: ${LATEST_CHROMIUM}"
@@ -400,7 +561,7 @@ build_chromium() {
   # run gclient sync (runhooks will run as part of this)
   log "Running gclient sync (this takes a while)"
   for i in {1..5}; do
-    yes | gclient sync --with_branch_heads --jobs 32 -RDf && break
+    yes | gclient sync --with_branch_heads --jobs "${NPROC}" -RDf && break
   done
 
   # cleanup any files in tree not part of this revision
@@ -410,8 +571,9 @@ build_chromium() {
   git checkout -- .
 
   # generate configuration
+  unseal_keys
   KEYSTORE="${KEYS_DIR}/${DEVICE}/chromium.keystore"
-  trichrome_certdigest=$(keytool -export-cert -alias chromium -keystore "${KEYSTORE}" -storepass chromium | sha256sum | awk '{print $1}')
+  trichrome_certdigest=$(keytool -export-cert -alias chromium -keystore "${KEYSTORE}" -storepass:file "${KEYSTORE_PASSWORD_FILE}" | sha256sum | awk '{print $1}')
   log "trichrome_certdigest=${trichrome_certdigest}"
   mkdir -p out/Default
   cat <<EOF > out/Default/args.gn
@@ -440,7 +602,7 @@ EOF
   gn gen out/Default
 
   log "Building trichrome"
-  autoninja -C out/Default/ trichrome_webview_64_32_apk trichrome_chrome_64_32_bundle trichrome_library_64_32_apk
+  autoninja -j "${NPROC}" -C out/Default/ trichrome_webview_64_32_apk trichrome_chrome_64_32_bundle trichrome_library_64_32_apk
 
   log "Signing trichrome"
   BUNDLETOOL="${HOME}/chromium/src/build/android/gyp/bundletool.py"
@@ -452,18 +614,19 @@ EOF
   mkdir release
   cd release
   "${BUNDLETOOL}" build-apks --aapt2 "${AAPT2}" --bundle "../TrichromeChrome6432.aab" --output "TrichromeChrome.apks" \
-      --mode=universal --ks "${KEYSTORE}" --ks-pass pass:chromium --ks-key-alias chromium
+      --mode=universal --ks "${KEYSTORE}" --ks-pass "file:${KEYSTORE_PASSWORD_FILE}" --ks-key-alias chromium
   unzip "TrichromeChrome.apks" "universal.apk"
   mv "universal.apk" "TrichromeChrome.apk"
   for app in TrichromeLibrary TrichromeWebView; do
-    "${APKSIGNER}" sign --ks "${KEYSTORE}" --ks-pass pass:chromium --ks-key-alias chromium --in "../${app}6432.apk" --out "${app}.apk"
+    "${APKSIGNER}" sign --ks "${KEYSTORE}" --ks-pass "file:${KEYSTORE_PASSWORD_FILE}" --ks-key-alias chromium --in "../${app}6432.apk" --out "${app}.apk"
   done
+  wipe_keys
 
   log "Uploading trichrome apks to s3"
-  retry sudo -E cp TrichromeLibrary.apk ${AWS_RELEASE_BUCKET}/chromium/TrichromeLibrary.apk
-  retry sudo -E cp TrichromeWebView.apk ${AWS_RELEASE_BUCKET}/chromium/TrichromeWebView.apk
-  retry sudo -E cp TrichromeChrome.apk ${AWS_RELEASE_BUCKET}/chromium/TrichromeChrome.apk
-  sudo -E bash -c "echo \"${CHROMIUM_REVISION}\" > ${AWS_RELEASE_BUCKET}/chromium/revision"
+  retry sudo -E cp TrichromeLibrary.apk ${STATE_BUCKET}/chromium/TrichromeLibrary.apk
+  retry sudo -E cp TrichromeWebView.apk ${STATE_BUCKET}/chromium/TrichromeWebView.apk
+  retry sudo -E cp TrichromeChrome.apk ${STATE_BUCKET}/chromium/TrichromeChrome.apk
+  sudo -E bash -c "echo \"${CHROMIUM_REVISION}\" > ${STATE_BUCKET}/chromium/revision"
 }
 
 aosp_repo_init() {
@@ -516,7 +679,7 @@ aosp_repo_sync() {
   # sync with retries
   for i in {1..10}; do
     log "aosp repo sync attempt ${i}/10"
-    repo sync -c --no-tags --no-clone-bundle --force-sync --jobs 32 && break
+    repo sync -c --no-tags --no-clone-bundle --force-sync --jobs "${NPROC}" && break
   done
   repo forall -vc "git reset --hard"
   repo forall -vc "git clean -f -d"
@@ -670,20 +833,8 @@ patch_device_config() {
   log_header "${FUNCNAME[0]}"
 
   # set proper model names
-  sed -i 's@PRODUCT_MODEL := AOSP on taimen@PRODUCT_MODEL := Pixel 2 XL@' "${BUILD_DIR}/device/google/taimen/aosp_taimen.mk" || true
-  sed -i 's@PRODUCT_MODEL := AOSP on walleye@PRODUCT_MODEL := Pixel 2@' "${BUILD_DIR}/device/google/muskie/aosp_walleye.mk" || true
-
-  sed -i 's@PRODUCT_MODEL := AOSP on crosshatch@PRODUCT_MODEL := Pixel 3 XL@' "${BUILD_DIR}/device/google/crosshatch/aosp_crosshatch.mk" || true
-  sed -i 's@PRODUCT_MODEL := AOSP on blueline@PRODUCT_MODEL := Pixel 3@' "${BUILD_DIR}/device/google/crosshatch/aosp_blueline.mk" || true
-
-  sed -i 's@PRODUCT_MODEL := AOSP on bonito@PRODUCT_MODEL := Pixel 3a XL@' "${BUILD_DIR}/device/google/bonito/aosp_bonito.mk" || true
-  sed -i 's@PRODUCT_MODEL := AOSP on sargo@PRODUCT_MODEL := Pixel 3a@' "${BUILD_DIR}/device/google/bonito/aosp_sargo.mk" || true
-
-  sed -i 's@PRODUCT_MODEL := AOSP on coral@PRODUCT_MODEL := Pixel 4 XL@' "${BUILD_DIR}/device/google/coral/aosp_coral.mk" || true
-  sed -i 's@PRODUCT_MODEL := AOSP on flame@PRODUCT_MODEL := Pixel 4@' "${BUILD_DIR}/device/google/coral/aosp_flame.mk" || true
-
-  sed -i 's@PRODUCT_MODEL := AOSP on sunfish@PRODUCT_MODEL := Pixel 4A@' "${BUILD_DIR}/device/google/sunfish/aosp_sunfish.mk" || true
-}
+<% range .SupportedDevices %>  sed -i 's@PRODUCT_MODEL := AOSP on <% .Codename %>@PRODUCT_MODEL := <% .ModelName %>@' "${BUILD_DIR}/<% .MakefilePath %>" || true
+<% end %>}
 
 patch_add_apps() {
   log_header "${FUNCNAME[0]}"
@@ -712,7 +863,7 @@ patch_updater() {
   log_header "${FUNCNAME[0]}"
 
   cd "${BUILD_DIR}/packages/apps/Updater/res/values"
-  sed --in-place --expression "s@s3bucket@${RELEASE_URL}/@g" config.xml
+  sed --in-place --expression "s@s3bucket@${RELEASE_URL}/${VARIANT_DIR}@g" config.xml
 
   # TODO: just a hack to get 11 up and running
   # related commit: https://android.googlesource.com/platform/system/sepolicy/+/d61b0ce1bc8de2560f1fa173c8d01a09d039a12a%5E%21/#F0
@@ -928,8 +1079,8 @@ patch_priv_ext() {
   # 0.2.9 added whitelabel support, so BuildConfig.APPLICATION_ID needs to be set now
   sed -i 's@BuildConfig.APPLICATION_ID@"org.fdroid.fdroid.privileged"@' "${BUILD_DIR}/packages/apps/F-DroidPrivilegedExtension/app/src/main/java/org/fdroid/fdroid/privileged/PrivilegedService.java"
 
-  unofficial_releasekey_hash=$(fdpe_hash "${KEYS_DIR}/${DEVICE}/releasekey.x509.pem")
-  unofficial_platform_hash=$(fdpe_hash "${KEYS_DIR}/${DEVICE}/platform.x509.pem")
+  unofficial_releasekey_hash=$(fdpe_hash "${KEYS_DIR}/${SIGNING_KEYS}/releasekey.x509.pem")
+  unofficial_platform_hash=$(fdpe_hash "${KEYS_DIR}/${SIGNING_KEYS}/platform.x509.pem")
   sed -i 's/'${OFFICIAL_FDROID_KEY}'")/'${unofficial_releasekey_hash}'"),\n            new Pair<>("org.fdroid.fdroid", "'${unofficial_platform_hash}'")/' \
       "${BUILD_DIR}/packages/apps/F-DroidPrivilegedExtension/app/src/main/java/org/fdroid/fdroid/privileged/ClientWhitelist.java"
 }
@@ -964,13 +1115,13 @@ build_aosp() {
   choosecombo ${BUILD_TARGET}
 
   log "Running target-files-package"
-  retry make -j "$(nproc)" target-files-package
+  retry make -j "${NPROC}" target-files-package
 
   log "Running brillo_update_payload"
-  retry make -j "$(nproc)" brillo_update_payload
+  retry make -j "${NPROC}" brillo_update_payload
 
   log "Running m otatools-package"
-  m otatools-package
+  m -j "${NPROC}" otatools-package
   rm -rf "${HOME}/release"
   mkdir -p "${HOME}/release"
   unzip "${BUILD_DIR}/out/target/product/${DEVICE}/otatools.zip" -d "${HOME}/release"
@@ -999,7 +1150,8 @@ release() {
   ############################
   # from original release.sh script
   ############################
-  KEY_DIR="keys/${DEVICE}"
+  unseal_keys
+  KEY_DIR="keys/${SIGNING_KEYS}"
   OUT="out/release-${DEVICE}-${BUILD_NUMBER}"
   device="${DEVICE}"
   source "device/common/clear-factory-images-variables.sh"
@@ -1055,9 +1207,16 @@ release() {
 	"${OUT}/${TARGET_FILES}"
 
   log "Running ota_from_target_files"
-  "${HOME}/release/releasetools/ota_from_target_files" --block -k "${KEY_DIR}/releasekey" "${EXTRA_OTA[@]}" "${OUT}/${TARGET_FILES}" \
+  # devices only install OTAs signed with the releasekey they run, during a
+  # key rotation that is the old key while the images are signed with the new
+  "${HOME}/release/releasetools/ota_from_target_files" --block -k "keys/${DEVICE}/releasekey" "${EXTRA_OTA[@]}" "${OUT}/${TARGET_FILES}" \
       "${OUT}/${DEVICE}-ota_update-${BUILD}.zip"
 
+  release_incremental
+
+  # everything below works on signed images only
+  wipe_keys
+
   log "Running img_from_target_files"
   sed -i 's/zipfile\.ZIP_DEFLATED/zipfile\.ZIP_STORED/' "${HOME}/release/releasetools/img_from_target_files.py"
   "${HOME}/release/releasetools/img_from_target_files" "${OUT}/${TARGET_FILES}" "${OUT}/${DEVICE}-img-${BUILD}.zip"
@@ -1075,6 +1234,34 @@ release() {
   time pxz -v -T0 -9 -z "${DEVICE}-factory-${BUILD_NUMBER}.tar"
 }
 
+# builds an incremental OTA from the target files of the previous release on
+# this channel, kept by aws_upload. it is optional, devices fall back to the full OTA without it
+release_incremental() {
+  previous=$(sudo -E bash -c "ls ${TARGET_FILES_DIR}/${DEVICE}-target-files-*.zip 2>/dev/null" | sort -V | tail -n 1)
+  if [ -z "${previous}" ]; then
+    log "No previous target files, skipping incremental OTA"
+    return
+  fi
+
+  previous_build=$(basename "${previous}" .zip)
+  previous_build="${previous_build#${DEVICE}-target-files-}"
+  if [ "${previous_build}" == "${BUILD}" ]; then
+    log "Previous target files are from this build, skipping incremental OTA"
+    return
+  fi
+
+  log "Running ota_from_target_files incremental from ${previous_build}"
+  sudo -E cp "${previous}" "${OUT}/${DEVICE}-target_files-${previous_build}.zip"
+  sudo -E chown "$(id -u):$(id -g)" "${OUT}/${DEVICE}-target_files-${previous_build}.zip"
+  if ! "${HOME}/release/releasetools/ota_from_target_files" --block -k "keys/${DEVICE}/releasekey" "${EXTRA_OTA[@]}" \
+      -i "${OUT}/${DEVICE}-target_files-${previous_build}.zip" "${OUT}/${TARGET_FILES}" \
+      "${OUT}/${DEVICE}-incremental-${previous_build}-${BUILD}.zip"; then
+    log "Failed to build incremental OTA from ${previous_build}, publishing the full OTA only"
+    rm -f "${OUT}/${DEVICE}-incremental-${previous_build}-${BUILD}.zip"
+  fi
+  rm -f "${OUT}/${DEVICE}-target_files-${previous_build}.zip"
+}
+
 # TODO: cleanup this function
 aws_upload() {
   log_header "${FUNCNAME[0]}"
@@ -1083,37 +1270,86 @@ aws_upload() {
   build_date="$(< soong/build_number.txt)"
   build_timestamp="$(unzip -p "release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip" "META-INF/com/android/metadata" | grep 'post-timestamp' | cut --delimiter "=" --fields 2)"
 
-  # copy ota file to s3, update file metadata used by updater app, and remove old ota files
+  # copy ota file to s3 and update file metadata used by updater app, old ota files are
+  # removed by localstack releases prune
   #read -r old_metadata <<< "$(wget -O - "${RELEASE_URL}/${RELEASE_CHANNEL}")"
   #old_date="$(cut -d ' ' -f 1 <<< "${old_metadata}")"
   #(
-  sudo -E cp ${BUILD_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip ${AWS_RELEASE_BUCKET} &&
-  sudo -E bash -c "echo \"${build_date} ${build_timestamp} ${AOSP_BUILD}\" > ${AWS_RELEASE_BUCKET}/${RELEASE_CHANNEL}" &&
-  sudo -E bash -c "echo \"${BUILD_TIMESTAMP}\" > ${AWS_RELEASE_BUCKET}/${RELEASE_CHANNEL}-true-timestamp"
+  # the optional fourth metadata field names the incremental OTA from the previous build
+  sudo -E mkdir -p ${RELEASE_BUCKET}
+  metadata="${build_date} ${build_timestamp} ${AOSP_BUILD}"
+  release_files=("${VARIANT_DIR}${DEVICE}-ota_update-${build_date}.zip")
+  for f in release-${DEVICE}-${build_date}/${DEVICE}-incremental-*-${build_date}.zip ; do
+    if [ -f "${f}" ]; then
+      sudo -E cp "${f}" ${RELEASE_BUCKET}
+      metadata="${metadata} $(basename "${f}")"
+      release_files+=("${VARIANT_DIR}$(basename "${f}")")
+    fi
+  done
+  sudo -E cp ${BUILD_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip ${RELEASE_BUCKET} &&
+  sudo -E bash -c "echo \"${metadata}\" > ${RELEASE_BUCKET}/${RELEASE_CHANNEL}" &&
+  sudo -E bash -c "echo \"${BUILD_TIMESTAMP}\" > ${RELEASE_BUCKET}/${RELEASE_CHANNEL}-true-timestamp"
   #) && ( aws s3 rm "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-ota_update-${old_date}.zip" || true )
 
-  # upload factory image
-  retry sudo -E cp ${BUILD_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-factory-${build_date}.tar.xz ${AWS_RELEASE_BUCKET}/${DEVICE}-factory-latest.tar.xz
+  # upload factory image, old ones are kept for the retention policy of localstack releases prune
+  retry sudo -E cp ${BUILD_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-factory-${build_date}.tar.xz ${RELEASE_BUCKET}
+  retry sudo -E cp ${RELEASE_BUCKET}/${DEVICE}-factory-${build_date}.tar.xz ${RELEASE_BUCKET}/${DEVICE}-factory-latest.tar.xz
+
+  release_files+=("${VARIANT_DIR}${DEVICE}-factory-${build_date}.tar.xz")
+  record_release "${build_date}" "${build_timestamp}" "${release_files[@]}"
 
   # cleanup old target files if some exist
-  if [ "$(sudo -E ls ${AWS_RELEASE_BUCKET}/${DEVICE}-target | wc -l)" != '0' ]; then
+  if [ "$(sudo -E ls ${TARGET_FILES_DIR} | wc -l)" != '0' ]; then
     cleanup_target_files
   fi
 
   # copy new target file to s3
-  sudo -E mkdir -p ${AWS_RELEASE_BUCKET}/${DEVICE}-target
-  retry sudo -E cp ${BUILD_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-target_files-${build_date}.zip ${AWS_RELEASE_BUCKET}/${DEVICE}-target/${DEVICE}-target-files-${build_date}.zip
+  sudo -E mkdir -p ${TARGET_FILES_DIR}
+  retry sudo -E cp ${BUILD_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-target_files-${build_date}.zip ${TARGET_FILES_DIR}/${DEVICE}-target-files-${build_date}.zip
+}
+
+# adds this build to the release index read by localstack releases, with the
+# versions it was built from and the files it published, relative to the
+# release directory
+record_release() {
+  build_date="$1"
+  ota_timestamp="$2"
+  shift 2
+
+  files="[]"
+  for f in "$@"; do
+    sha256=$(sudo -E sha256sum "${AWS_RELEASE_BUCKET}/${f}" | awk '{print $1}')
+    size=$(sudo -E stat -c %s "${AWS_RELEASE_BUCKET}/${f}")
+    files=$(jq -c --arg name "${f}" --arg sha256 "${sha256}" --argjson size "${size}" \
+      '. + [{name: $name, sha256: $sha256, size: $size}]' <<< "${files}")
+  done
+
+  sudo -E mkdir -p "${AWS_RELEASE_BUCKET}/index"
+  index_name="${DEVICE}-${build_date}"
+  if [ -n "${VARIANT_DIR}" ]; then
+    index_name="${DEVICE}-${BUILD_TYPE}-${build_date}"
+  fi
+
+  jq -n --arg device "${DEVICE}" --arg profile "${PROFILE}" --arg variant "${BUILD_TYPE}" --arg channel "${BUILD_CHANNEL}" \
+      --arg build "${build_date}" --argjson timestamp "${ota_timestamp}" --argjson true_timestamp "${BUILD_TIMESTAMP}" \
+      --arg aosp_build "${AOSP_BUILD}" --arg chromium "${LATEST_CHROMIUM}" \
+      --arg fdroid_client "${FDROID_CLIENT_VERSION}" --arg fdroid_priv_ext "${FDROID_PRIV_EXT_VERSION}" \
+      --argjson published "$(date +%s)" --argjson files "${files}" \
+      '{device: $device, profile: $profile, variant: $variant, channel: $channel, build: $build, timestamp: $timestamp,
+        true_timestamp: $true_timestamp, aosp_build: $aosp_build, chromium: $chromium,
+        fdroid_client: $fdroid_client, fdroid_priv_ext: $fdroid_priv_ext, published: $published, files: $files}' \
+    | sudo -E tee "${AWS_RELEASE_BUCKET}/index/${index_name}.json" > /dev/null
 }
 
 cleanup_target_files() {
   log_header "${FUNCNAME[0]}"
 
-  sudo -E rsync -avz --delete ${AWS_RELEASE_BUCKET}/${DEVICE}-target ${BUILD_DIR}/
-  sudo -E rsync -avz --delete ${BUILD_DIR}/${DEVICE}-target ${AWS_RELEASE_BUCKET}
-  cd "${BUILD_DIR}/${DEVICE}-target"
+  sudo -E rsync -avz --delete ${TARGET_FILES_DIR} ${BUILD_DIR}/
+  sudo -E rsync -avz --delete ${BUILD_DIR}/${RELEASE_CHANNEL}-target ${STATE_BUCKET}
+  cd "${BUILD_DIR}/${RELEASE_CHANNEL}-target"
   for target_file in ${DEVICE}-target-files-*.zip ; do
     old_date=$(echo "${target_file}" | cut --delimiter "-" --fields 4 | cut --delimiter "." --fields 5 --complement)
-    sudo -E rm ${AWS_RELEASE_BUCKET}/${DEVICE}-target/${DEVICE}-target-files-${old_date}.zip || true
+    sudo -E rm ${TARGET_FILES_DIR}/${DEVICE}-target-files-${old_date}.zip || true
   done
 }
 
@@ -1121,32 +1357,36 @@ checkpoint_versions() {
   log_header "${FUNCNAME[0]}"
 
   # checkpoint stack version
-  sudo -E mkdir -p ${AWS_RELEASE_BUCKET}/rattlesnakeos-stack
-  sudo -E bash -c "echo \"${STACK_VERSION}\" > ${AWS_RELEASE_BUCKET}/rattlesnakeos-stack/revision"
+  sudo -E mkdir -p ${STATE_BUCKET}/rattlesnakeos-stack
+  sudo -E bash -c "echo \"${STACK_VERSION}\" > ${STATE_BUCKET}/rattlesnakeos-stack/revision"
 
   # checkpoint f-droid
-  sudo -E mkdir -p ${AWS_RELEASE_BUCKET}/fdroid
-  sudo -E mkdir -p ${AWS_RELEASE_BUCKET}/fdroid-priv
-  sudo -E bash -c "echo \"${FDROID_PRIV_EXT_VERSION}\" > ${AWS_RELEASE_BUCKET}/fdroid-priv/revision"
-  sudo -E bash -c "echo \"${FDROID_CLIENT_VERSION}\" > ${AWS_RELEASE_BUCKET}/fdroid/revision"
+  sudo -E mkdir -p ${STATE_BUCKET}/fdroid
+  sudo -E mkdir -p ${STATE_BUCKET}/fdroid-priv
+  sudo -E bash -c "echo \"${FDROID_PRIV_EXT_VERSION}\" > ${STATE_BUCKET}/fdroid-priv/revision"
+  sudo -E bash -c "echo \"${FDROID_CLIENT_VERSION}\" > ${STATE_BUCKET}/fdroid/revision"
 
   # checkpoint aosp
-  sudo -E bash -c "echo  ${AOSP_VENDOR_BUILD} > ${AWS_RELEASE_BUCKET}/${DEVICE}-vendor || true"
+  sudo -E bash -c "echo  ${AOSP_VENDOR_BUILD} > ${STATE_BUCKET}/${DEVICE}-vendor || true"
 
   # checkpoint chromium
-  sudo -E mkdir -p ${AWS_RELEASE_BUCKET}/chromium
-  sudo -E bash -c "echo yes > ${AWS_RELEASE_BUCKET}/chromium/included"
+  sudo -E mkdir -p ${STATE_BUCKET}/chromium
+  sudo -E bash -c "echo yes > ${STATE_BUCKET}/chromium/included"
 }
 
+# errors are reported with the FAILED notification sent on exit
 aws_notify_simple() {
   log_header "${FUNCNAME[0]}"
 
   echo "$1"
+  FAILURE_REASON="$1"
 }
 
+# aws_notify <message> <STARTED|SUCCESS|FAILED|NOT_REQUIRED>
 aws_notify() {
   log_header "${FUNCNAME[0]}"
   echo "$1"
+  event notify "$2" "$1"
 }
 
 aws_logging() {
@@ -1159,6 +1399,18 @@ aws_logging() {
 aws_import_keys() {
   log_header "${FUNCNAME[0]}"
 
+  if [ "${ENCRYPTED_KEYS}" == "true" ]; then
+    import_sealed_keys
+  else
+    import_plain_keys
+  fi
+
+  if [ "${ROTATE_KEYS}" == "true" ]; then
+    import_rotation_keys
+  fi
+}
+
+import_plain_keys() {
   if [ "$(sudo -E ls ${AWS_KEYS_BUCKET}/${DEVICE} | wc -l)" == '0' ]; then
     log "No keys were found - generating keys"
     gen_keys
@@ -1174,44 +1426,262 @@ aws_import_keys() {
   pushd "${KEYS_DIR}/${DEVICE}"
   if [ ! -f "${KEYS_DIR}/${DEVICE}/chromium.keystore" ]; then
     log "Did not find chromium.keystore - generating"
-	keytool -genkey -v -keystore chromium.keystore -storetype pkcs12 -alias chromium -keyalg RSA -keysize 4096 \
-        -sigalg SHA512withRSA -validity 10000 -dname "cn=RattlesnakeOS" -storepass chromium
+    gen_chromium_keystore
     log "Uploading new chromium.keystore"
     sudo -E rsync -avz ${KEYS_DIR}/ ${AWS_KEYS_BUCKET}
+  elif [ ! -f "${KEYS_DIR}/${DEVICE}/chromium.x509.pem" ]; then
+    export_chromium_cert
+    sudo -E rsync -avz ${KEYS_DIR}/ ${AWS_KEYS_BUCKET}
+  fi
+  popd
+}
+
+# import_sealed_keys generates or seals the keys of DEVICE, keys stored
+# in plain text by an earlier build are sealed and removed from the volume
+import_sealed_keys() {
+  changed=false
+
+  if sudo -E test -f "$(sealed_keys)"; then
+    log "Sealed keys exist for ${DEVICE}"
+    unseal_key_set "${DEVICE}"
+  elif sudo -E test -f "${AWS_KEYS_BUCKET}/${DEVICE}/releasekey.pk8"; then
+    log "Found unencrypted keys for ${DEVICE} - sealing them"
+    mkdir -p "${KEYS_DIR}/${DEVICE}"
+    sudo -E rsync -avz ${AWS_KEYS_BUCKET}/${DEVICE}/ ${KEYS_DIR}/${DEVICE}
+    sudo -E chown -R build:build ${KEYS_DIR}
+    changed=true
+  else
+    log "No keys were found - generating keys"
+    gen_keys
+    changed=true
+  fi
+
+  pushd "${KEYS_DIR}/${DEVICE}"
+  if [ ! -f "${KEYS_DIR}/${DEVICE}/chromium.keystore" ]; then
+    log "Did not find chromium.keystore - generating"
+    gen_chromium_keystore
+    changed=true
+  elif [ ! -f "${KEYS_DIR}/${DEVICE}/chromium.x509.pem" ]; then
+    export_chromium_cert
+    changed=true
   fi
   popd
+
+  if [ "${changed}" == "true" ]; then
+    seal_keys
+  fi
+  wipe_keys
+}
+
+# import_rotation_keys generates the new key set of a key rotation next to
+# the current one, unless an earlier attempt of the rotation already did
+import_rotation_keys() {
+  newkeys="${DEVICE}.new"
+
+  if sudo -E test -f "$(sealed_keys "${newkeys}")" || sudo -E test -f "${AWS_KEYS_BUCKET}/${newkeys}/releasekey.pk8"; then
+    log "Rotating to the new keys generated by an earlier attempt"
+    return
+  fi
+
+  log "Generating new keys to rotate to"
+  if [ "${ENCRYPTED_KEYS}" == "true" ]; then
+    unseal_key_set "${DEVICE}"
+  fi
+  gen_keys "${newkeys}"
+
+  # the chromium apps are updated like any other app, keep their key
+  cp "${KEYS_DIR}/${DEVICE}/chromium.keystore" "${KEYS_DIR}/${DEVICE}/chromium.x509.pem" "${KEYS_DIR}/${newkeys}/"
+
+  if [ "${ENCRYPTED_KEYS}" == "true" ]; then
+    seal_keys "${newkeys}"
+    wipe_keys
+  else
+    sudo -E rsync -avz ${KEYS_DIR}/ ${AWS_KEYS_BUCKET}
+  fi
+}
+
+# finish_key_rotation archives the old keys once the transition OTA signed
+# with them is published and makes the new keys the current ones. It is the
+# last step so a rotation interrupted after aws_upload resumes here, every
+# move is skipped if an earlier attempt already made it
+finish_key_rotation() {
+  log_header "${FUNCNAME[0]}"
+
+  if [ "${ROTATE_KEYS}" != "true" ]; then
+    log "Not rotating keys"
+    return
+  fi
+
+  newkeys="${DEVICE}.new"
+  archive="${AWS_KEYS_BUCKET}/archive/${DEVICE}-${BUILD_DATE}"
+
+  log "Archiving old keys of ${DEVICE} to ${archive}"
+  sudo -E mkdir -p "${archive}"
+  if sudo -E test -d "${AWS_KEYS_BUCKET}/${newkeys}"; then
+    if sudo -E test -d "${AWS_KEYS_BUCKET}/${DEVICE}"; then
+      sudo -E mv "${AWS_KEYS_BUCKET}/${DEVICE}" "${archive}/${DEVICE}"
+    fi
+    sudo -E mv "${AWS_KEYS_BUCKET}/${newkeys}" "${AWS_KEYS_BUCKET}/${DEVICE}"
+  fi
+  if sudo -E test -f "$(sealed_keys "${newkeys}")"; then
+    if sudo -E test -f "$(sealed_keys)"; then
+      sudo -E mv "$(sealed_keys)" "${archive}/"
+    fi
+    sudo -E mv "$(sealed_keys "${newkeys}")" "$(sealed_keys)"
+  fi
+
+  if [ -d "${KEYS_DIR}/${newkeys}" ]; then
+    rm -rf "${KEYS_DIR:?}/${DEVICE}"
+    mv "${KEYS_DIR}/${newkeys}" "${KEYS_DIR}/${DEVICE}"
+  fi
 }
 
+gen_chromium_keystore() {
+  # keytool wants the subject as CN=.., O=.. instead of /O=../CN=..
+  dname=$(echo "${CERTIFICATE_SUBJECT}" | sed -e 's|^/||' -e 's|/|, |g')
+  keytool -genkey -v -keystore chromium.keystore -storetype pkcs12 -alias chromium -keyalg RSA -keysize "${AVB_KEY_RSA_SIZE}" \
+      -sigalg SHA512withRSA -validity "${KEY_VALIDITY_DAYS}" -dname "${dname}" -storepass:file "${KEYSTORE_PASSWORD_FILE}"
+  export_chromium_cert
+}
+
+# the certificate is kept next to the keystore so it can be checked without
+# unsealing the keys
+export_chromium_cert() {
+  keytool -export-cert -rfc -alias chromium -keystore chromium.keystore -storepass:file "${KEYSTORE_PASSWORD_FILE}" -file chromium.x509.pem
+}
+
+# gen_keys [key set] generates a key set, DEVICE by default. The new keys of
+# a rotation keep the AVB key unless ROTATE_AVB is set
 gen_keys() {
   log_header "${FUNCNAME[0]}"
+  local keyset="${1:-${DEVICE}}"
 
   # download make_key and avbtool as aosp tree isn't downloaded yet
   make_key="${HOME}/make_key"
   retry curl --fail -s "https://android.googlesource.com/platform/development/+/refs/tags/${AOSP_BRANCH}/tools/make_key?format=TEXT" | base64 --decode > "${make_key}"
   chmod +x "${make_key}"
+  # make_key hardcodes 2048 bit keys valid for 10000 days
+  if ! grep -q 'genrsa -f4 2048' "${make_key}" || ! grep -q -- '-days 10000' "${make_key}"; then
+    aws_notify_simple "ERROR: unable to set the key size and validity in make_key. Stopping build."
+    exit 1
+  fi
+  sed -i -e "s/genrsa -f4 2048/genrsa -f4 ${KEY_RSA_SIZE}/" -e "s/-days 10000/-days ${KEY_VALIDITY_DAYS}/" "${make_key}"
   avb_tool="${HOME}/avbtool"
   retry curl --fail -s "https://android.googlesource.com/platform/external/avb/+/refs/tags/${AOSP_BRANCH}/avbtool?format=TEXT" | base64 --decode > "${avb_tool}"
   chmod +x "${avb_tool}"
 
   # generate releasekey,platform,shared,media,networkstack keys
-  mkdir -p "${KEYS_DIR}/${DEVICE}"
-  cd "${KEYS_DIR}/${DEVICE}"
+  mkdir -p "${KEYS_DIR}/${keyset}"
+  cd "${KEYS_DIR}/${keyset}"
   for key in {releasekey,platform,shared,media,networkstack} ; do
     # make_key exits with unsuccessful code 1 instead of 0, need ! to negate
     ! "${make_key}" "${key}" "${CERTIFICATE_SUBJECT}"
   done
 
+  if [ "${keyset}" != "${DEVICE}" ] && [ "${ROTATE_AVB}" != "true" ]; then
+    log "Keeping the AVB key of ${DEVICE}"
+    cp "${KEYS_DIR}/${DEVICE}/avb.pem" "${KEYS_DIR}/${DEVICE}/avb_pkmd.bin" "${KEYS_DIR}/${keyset}/"
+    return
+  fi
+
   # generate avb key
-  openssl genrsa -out "${KEYS_DIR}/${DEVICE}/avb.pem" 4096
-  "${avb_tool}" extract_public_key --key "${KEYS_DIR}/${DEVICE}/avb.pem" --output "${KEYS_DIR}/${DEVICE}/avb_pkmd.bin"
+  openssl genrsa -out "${KEYS_DIR}/${keyset}/avb.pem" "${AVB_KEY_RSA_SIZE}"
+  "${avb_tool}" extract_public_key --key "${KEYS_DIR}/${keyset}/avb.pem" --output "${KEYS_DIR}/${keyset}/avb_pkmd.bin"
 }
 
 cleanup() {
   rv=$?
+  if [ -n "${CURRENT_STEP}" ]; then
+    if [ $rv -ne 0 ]; then
+      event fail "${CURRENT_STEP}"
+    else
+      event end "${CURRENT_STEP}"
+    fi
+  fi
+  wipe_keys
+  rm -f "${SECRETS_DIR}"/*
   aws_logging
   if [ $rv -ne 0 ]; then
-    aws_notify "RattlesnakeOS Build FAILED" 1
+    aws_notify "RattlesnakeOS Build FAILED ${FAILURE_REASON}" FAILED
+  fi
+  event exit "${rv}"
+}
+
+# report progress to localstack, see stack/progress.go for the format
+event() {
+  if [ -n "${LOCALSTACK_EVENTS}" ]; then
+    echo "$(date +%s) $*" | sudo -E tee -a "${LOCALSTACK_EVENTS}" > /dev/null
+  fi
+}
+
+# versions a step depends on, a checkpoint is only valid for the same inputs.
+# the source tree may be shared with other profiles and variants so they are
+# part of it too
+# the certificate of the releasekey tells key sets with the same name apart,
+# e.g. before and after a key rotation. it is readable even if the keys are
+# sealed
+signing_keys_id() {
+  sudo -E sha256sum "${AWS_KEYS_BUCKET}/${SIGNING_KEYS}/releasekey.x509.pem" 2>/dev/null | awk '{print $1}'
+}
+
+step_inputs() {
+  echo "${PROFILE} ${DEVICE} ${BUILD_TYPE} ${SIGNING_KEYS} $(signing_keys_id) ${STACK_VERSION} ${AOSP_BUILD} ${AOSP_BRANCH} ${AOSP_VENDOR_BUILD} ${LATEST_CHROMIUM} ${FDROID_CLIENT_VERSION} ${FDROID_PRIV_EXT_VERSION}"
+}
+
+skip_step() {
+  if [[ "${SETUP_STEPS}" == *" $1 "* ]]; then
+    return 1
+  fi
+  if [ -n "${ONLY_STEP}" ]; then
+    [ "$1" != "${ONLY_STEP}" ]
+    return
+  fi
+  if [ -n "${FROM_STEP}" ]; then
+    [ "$1" != "${FROM_STEP}" ]
+    return
+  fi
+  if [ "${RESUME_BUILD}" = true ]; then
+    [ "$(cat "${CHECKPOINT_DIR}/$1" 2>/dev/null)" == "$(step_inputs)" ]
+    return
+  fi
+  return 1
+}
+
+# everything after a step that runs again has to run again as well
+invalidate_checkpoints() {
+  local found=false
+  for s in "${BUILD_STEPS[@]}"; do
+    if [ "${s}" == "$1" ]; then
+      found=true
+    fi
+    if [ "${found}" = true ]; then
+      rm -f "${CHECKPOINT_DIR}/${s}"
+    fi
+  done
+}
+
+run_step() {
+  if skip_step "$1"; then
+    log "Skipping $1"
+    event skip "$1"
+    return
+  fi
+
+  CURRENT_STEP="$1"
+  if [[ "${SETUP_STEPS}" != *" $1 "* ]]; then
+    # once one step has run the following ones can't be skipped
+    RESUME_BUILD=false
+    FROM_STEP=
+    mkdir -p "${CHECKPOINT_DIR}"
+    invalidate_checkpoints "$1"
+  fi
+  event start "$1"
+  "$@"
+  if [[ "${SETUP_STEPS}" != *" $1 "* ]]; then
+    step_inputs > "${CHECKPOINT_DIR}/$1"
   fi
+  event end "$1"
+  CURRENT_STEP=
 }
 
 log_header() {
@@ -1258,6 +1728,10 @@ retry() {
 }
 
 trap cleanup 0
+# localstack cancels a build by sending SIGTERM to its process group, exit
+# through cleanup so the failed step and the keys are taken care of
+trap 'FAILURE_REASON="(cancelled)"; exit 143' TERM
+trap 'FAILURE_REASON="(interrupted)"; exit 130' INT
 
 set -e
 
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+func init() {
+	rootCmd.AddCommand(attachCmd)
+}
+
+var attachCmd = &cobra.Command{
+	Use:   "attach [profile]",
+	Short: "Follow the output of a detached build until it finishes",
+	Long: "Follow the output of a detached build until it finishes. Interrupting attach leaves the build " +
+		"running, it defaults to the most recently started detached build.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("statepath") == "" {
+			return fmt.Errorf("must specify statepath")
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one profile")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		statePath := viper.GetString("statepath")
+
+		target := ""
+		if len(args) == 1 {
+			target = args[0]
+		}
+
+		b, err := stack.FindDetachedBuild(statePath, target)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+		go func() {
+			<-sig
+			cancel()
+		}()
+
+		status, err := b.Attach(ctx, statePath, os.Stdout)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if status.Running {
+			log.Infof("detached from build %s, it keeps running in the background", b.ID)
+			return
+		}
+
+		if status.ExitCode != 0 {
+			log.Fatalf("build %s of %s failed with exit code %d", b.ID, b.Target, status.ExitCode)
+		}
+
+		log.Infof("build %s of %s finished", b.ID, b.Target)
+	},
+}
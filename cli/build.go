@@ -2,14 +2,26 @@ package cli
 
 import (
 	"fmt"
-	"log"
+	osuser "os/user"
+	"strings"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
+	"github.io/gnu3ra/localstack/ota"
 	"github.io/gnu3ra/localstack/stack"
 	"github.com/spf13/viper"
 )
 
 var forceBuild bool
+var aospBuild, aospBranch string
+var resumeBuild bool
+var fromStep, onlyStep string
+var buildTarget string
+var buildAll bool
+var maxParallelBuilds int
+var detachBuild bool
+var buildChannel, buildVariant string
 
 func init() {
 	rootCmd.AddCommand(buildCmd)
@@ -17,16 +29,238 @@ func init() {
 	flags := buildCmd.Flags()
 
 	flags.BoolVarP(&forceBuild, "force", "f", false, "skip version check and force a complete rebuild")
+
+	flags.StringVar(&aospBuild, "aosp-build", "",
+		"pin the AOSP build id (e.g. RP1A.201005.004), defaults to the build matching the latest vendor files")
+
+	flags.StringVar(&aospBranch, "aosp-branch", "",
+		"pin the AOSP tag to sync (e.g. android-11.0.0_r4), defaults to the tag matching the latest vendor files")
+
+	flags.BoolVar(&resumeBuild, "resume", false, "skip steps that already completed with the same versions")
+
+	flags.StringVar(&fromStep, "from-step", "",
+		fmt.Sprintf("skip every step before this one, one of: %s", strings.Join(stack.SelectableSteps(), ", ")))
+
+	flags.StringVar(&onlyStep, "only-step", "",
+		"only run this step (setup steps always run). Steps like apply_patches are not safe to run twice on the same tree")
+
+	flags.StringVar(&buildTarget, "device", "", "profile or device to build, defaults to the configured device")
+
+	flags.BoolVar(&buildAll, "all", false, "build the configured device and every profile")
+
+	flags.IntVar(&maxParallelBuilds, "parallel", 1,
+		"number of profiles to build at the same time, profiles sharing an AOSP branch are always built one after the other")
+
+	flags.BoolVar(&detachBuild, "detach", false,
+		"start the build in the background and return, see localstack status and localstack attach. Not available with notifications configured")
+
+	flags.StringVar(&buildChannel, "channel", "",
+		fmt.Sprintf("release channel to publish the build to, one of: %s. Defaults to the channel of the profile or dev",
+			strings.Join(ota.Channels, ", ")))
+
+	flags.StringVar(&buildVariant, "variant", "",
+		fmt.Sprintf("build variant, one of: %s. Defaults to the variant of the profile or the variant config key",
+			strings.Join(ota.Variants, ", ")))
+}
+
+// parallelBuilds returns the --parallel flag of cmd, falling back to
+// max-parallel-builds from the config file. The flag is shared by several
+// commands so it can't be bound to the config key.
+func parallelBuilds(cmd *cobra.Command) int {
+	if cmd.Flags().Changed("parallel") || !viper.IsSet("max-parallel-builds") {
+		return maxParallelBuilds
+	}
+	return viper.GetInt("max-parallel-builds")
+}
+
+// memoryLimits parses the memory and swap sizes from the config file, e.g.
+// "32g". Zero means no limit for memory and no swap on top of it.
+func memoryLimits() (int64, int64, error) {
+	var limits [2]int64
+
+	for i, key := range []string{"memory", "swap"} {
+		size := viper.GetString(key)
+
+		if size == "" {
+			continue
+		}
+
+		n, err := units.RAMInBytes(size)
+
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q, expected a size like 32g", key, size)
+		}
+
+		limits[i] = n
+	}
+
+	if limits[1] > 0 && limits[0] == 0 {
+		return 0, 0, fmt.Errorf("swap is only used with a memory limit")
+	}
+
+	return limits[0], limits[1], nil
 }
 
+// stackConfig collects the stack configuration from the config file and flags.
+func stackConfig() (*stack.DockerStackConfig, error) {
+	viper.UnmarshalKey("custom-patches", patches)
+	viper.UnmarshalKey("custom-scripts", scripts)
+	viper.UnmarshalKey("custom-prebuilts", prebuilts)
+	viper.UnmarshalKey("custom-manifest-remotes", manifestRemotes)
+	viper.UnmarshalKey("custom-manifest-projects", manifestProjects)
+
+	u, err := osuser.Current()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	p, err := profiles()
+
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := keysConfig()
+
+	if err != nil {
+		return nil, err
+	}
+
+	memory, swap, err := memoryLimits()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &stack.DockerStackConfig{
+		Name:                   viper.GetString("name"),
+		Device:                 viper.GetString("device"),
+		Email:                  viper.GetString("email"),
+		SSHKey:                 viper.GetString("ssh-key"),
+		Schedule:               viper.GetString("schedule"),
+		ChromiumVersion:        viper.GetString("chromium-version"),
+		HostsFile:              viper.GetString("hosts-file"),
+		CustomPatches:          patches,
+		CustomScripts:          scripts,
+		CustomPrebuilts:        prebuilts,
+		CustomManifestRemotes:  manifestRemotes,
+		CustomManifestProjects: manifestProjects,
+		Version:                version,
+		EnableAttestation:      viper.GetBool("attestation-server"),
+		AttestationCommit:      viper.GetString("attestation-commit"),
+		EncryptedKeys:          viper.GetBool("encrypted-keys"),
+		Keys:                   *k,
+		AttestationPort:        viper.GetInt("attestation-port"),
+		StatePath:              viper.GetString("statepath"),
+		ReleaseURL:             strings.TrimSuffix(viper.GetString("release-url"), "/"),
+		Variant:                viper.GetString("variant"),
+		NumProc:                viper.GetInt("nproc"),
+		Memory:                 memory,
+		Swap:                   swap,
+		PidsLimit:              viper.GetInt64("pids-limit"),
+		Uid:                    u.Uid,
+		Gid:                    u.Gid,
+		Profiles:               p,
+		Runtime:                viper.GetString("runtime"),
+		PodmanURL:              viper.GetString("podman-url"),
+	}, nil
+}
+
+// shutdown shuts c down without exiting on errors, so the remaining stacks
+// are shut down too.
 func shutdown(c *stack.DockerStack) {
 	err := c.Shutdown()
 
 	if (err != nil) {
-		log.Fatalf("failed to shutdown: %v", err)
+		log.Errorf("failed to shutdown: %v", err)
 	}
 }
 
+// build runs the build command. Every stack is shut down before it returns,
+// also when the build is interrupted.
+func build(cmd *cobra.Command) error {
+	config, err := stackConfig()
+
+	if (err != nil) {
+		return err
+	}
+
+	backends, err := notifiers()
+
+	if (err != nil) {
+		return err
+	}
+
+	if detachBuild && len(backends) > 0 {
+		// nothing follows the events of a detached build to deliver them
+		return fmt.Errorf("detached builds can't send notifications, remove email, notify-webhook and " +
+			"notify-command from the config file or build without --detach")
+	}
+
+	passphrase, err := keysPassphrase(config, true)
+
+	if (err != nil) {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	c, err := stack.NewDockerStack(config)
+
+	if (err != nil) {
+		return err
+	}
+
+	targets, err := buildTargets(c, config, buildTarget, buildAll)
+
+	if (err != nil) {
+		shutdown(c)
+		return err
+	}
+
+	if aospBuild != "" {
+		for _, t := range targets {
+			vendorBuild, err := stack.LatestVendorBuild(t.Device())
+
+			if err != nil {
+				log.Warnf("unable to check requested AOSP build against vendor files: %v", err)
+			} else if vendorBuild != aospBuild {
+				log.Warnf("WARNING: requested AOSP build %s does not match the vendor build %s for %s. "+
+					"The resulting images may not be functional.", aospBuild, vendorBuild, t.Device())
+			}
+		}
+	}
+
+	opts := stack.BuildOptions{
+		Force:          forceBuild,
+		AOSPBuild:      aospBuild,
+		AOSPBranch:     aospBranch,
+		Resume:         resumeBuild,
+		FromStep:       fromStep,
+		OnlyStep:       onlyStep,
+		KeysPassphrase: passphrase,
+		Channel:        buildChannel,
+		Variant:        buildVariant,
+	}
+
+	if detachBuild {
+		opts.Detach = true
+		err = targets[0].Build(ctx, &opts)
+
+		if targets[0] != c {
+			shutdown(targets[0])
+		}
+
+		shutdown(c)
+
+		return err
+	}
+
+	return runBuilds(ctx, c, config.Name, targets, opts, backends, parallelBuilds(cmd))
+}
+
 var buildCmd = &cobra.Command{
 	Use: "build",
 	Short: "Launched a one-shot build of localstack.",
@@ -35,43 +269,25 @@ var buildCmd = &cobra.Command{
 		if (err != nil) {
 			return fmt.Errorf("error: stack is not deployed: %v", err)
 		}
+		if fromStep != "" && onlyStep != "" {
+			return fmt.Errorf("--from-step and --only-step are mutually exclusive")
+		}
+		if buildAll && buildTarget != "" {
+			return fmt.Errorf("--all and --device are mutually exclusive")
+		}
+		if detachBuild && buildAll {
+			return fmt.Errorf("--detach builds a single profile, use --device to choose it")
+		}
+		if buildChannel != "" && !ota.ValidChannel(buildChannel) {
+			return fmt.Errorf("invalid channel %s, must be one of %s", buildChannel, strings.Join(ota.Channels, ", "))
+		}
+		if buildVariant != "" && !ota.ValidVariant(buildVariant) {
+			return fmt.Errorf("invalid variant %s, must be one of %s", buildVariant, strings.Join(ota.Variants, ", "))
+		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		viper.UnmarshalKey("custom-patches", patches)
-		viper.UnmarshalKey("custom-scripts", scripts)
-		viper.UnmarshalKey("custom-prebuilts", prebuilts)
-		viper.UnmarshalKey("custom-manifest-remotes", manifestRemotes)
-		viper.UnmarshalKey("custom-manifest-projects", manifestProjects)
-		c, err := stack.NewDockerStack(&stack.DockerStackConfig{
-			Name:                   viper.GetString("name"),
-			Device:                 viper.GetString("device"),
-			Email:                  viper.GetString("email"),
-			SSHKey:                 viper.GetString("ssh-key"),
-			Schedule:               viper.GetString("schedule"),
-			ChromiumVersion:        viper.GetString("chromium-version"),
-			HostsFile:              viper.GetString("hosts-file"),
-			CustomPatches:          patches,
-			CustomScripts:          scripts,
-			CustomPrebuilts:        prebuilts,
-			CustomManifestRemotes:  manifestRemotes,
-			CustomManifestProjects: manifestProjects,
-			Version:                version,
-			EnableAttestation:      viper.GetBool("attestation-server"),
-			StatePath:              viper.GetString("statepath"),
-			NumProc:                viper.GetInt("nproc"),
-		})
-
-		if (err != nil) {
-			log.Fatal(err)
-			return
-		}
-
-		defer shutdown(c)
-	
-		err = c.Build(forceBuild)
-
-		if (err != nil) {
+		if err := build(cmd); err != nil {
 			log.Fatal(err)
 		}
 	},
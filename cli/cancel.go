@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+func init() {
+	rootCmd.AddCommand(cancelCmd)
+}
+
+// cancelBuild stops the detached build of target, or the most recently
+// started one if target is empty.
+func cancelBuild(target string) error {
+	if target == "" {
+		b, err := stack.FindDetachedBuild(viper.GetString("statepath"), "")
+
+		if err != nil {
+			return err
+		}
+
+		target = b.Target
+	}
+
+	config, err := stackConfig()
+
+	if err != nil {
+		return err
+	}
+
+	c, err := stack.NewDockerStack(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer shutdown(c)
+
+	targets, err := buildTargets(c, config, target, false)
+
+	if err != nil {
+		return err
+	}
+
+	if targets[0] != c {
+		defer shutdown(targets[0])
+	}
+
+	return targets[0].Cancel()
+}
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [profile]",
+	Short: "Stop a detached build",
+	Long: "Stop a detached build, it defaults to the most recently started one. The build gets the stop " +
+		"timeout to clean up before its container is stopped.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := deployCheck(cmd, args); err != nil {
+			return fmt.Errorf("error: stack is not deployed: %v", err)
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one profile")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		target := ""
+		if len(args) == 1 {
+			target = args[0]
+		}
+
+		if err := cancelBuild(target); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("build cancelled")
+	},
+}
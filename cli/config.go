@@ -8,7 +8,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/devices"
 	"math/rand"
+	"net/url"
 	"os"
 	"runtime"
 	"strconv"
@@ -23,19 +25,12 @@ var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "Setup config file for localstack",
 	Run: func(cmd *cobra.Command, args []string) {
-		color.Cyan(fmt.Sprintln("Device is the device codename (e.g. sailfish). Supported devices:", supportDevicesOutput))
+		color.Cyan(fmt.Sprintln("Device is the device codename (e.g. bonito). Supported devices:", devices.Describe()))
 		validate := func(input string) error {
 			if len(input) < 1 {
 				return errors.New("Device name is too short")
 			}
-			found := false
-			for _, d := range supportedDevicesCodename {
-				if input == d {
-					found = true
-					break
-				}
-			}
-			if !found {
+			if _, err := devices.Lookup(input); err != nil {
 				return errors.New("Invalid device")
 			}
 			return nil
@@ -102,6 +97,33 @@ var configCmd = &cobra.Command{
 
 		viper.Set("nproc", result)
 
+		color.Cyan(fmt.Sprintln("Public URL devices will fetch OTA updates from (served by 'localstack serve')"))
+
+		validate = func(input string) error {
+			if input == "" {
+				return nil
+			}
+			u, err := url.Parse(input)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("enter an http(s) url")
+			}
+			return nil
+		}
+
+		releaseURLPrompt := promptui.Prompt{
+			Label:    "Release URL ",
+			Validate: validate,
+			Default:  viper.GetString("release-url"),
+		}
+
+		result, err = releaseURLPrompt.Run()
+
+		if err != nil {
+			log.Fatalf("Prompt failed: %v", err)
+		}
+
+		viper.Set("release-url", result)
+
 		err = viper.WriteConfigAs(configFileFullPath)
 		if err != nil {
 			log.WithError(err).Fatalf("failed to write config file %s", configFileFullPath)
@@ -0,0 +1,189 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+const daemonRecordFile = "daemon.json"
+
+var runNow bool
+
+// daemonRecord is persisted after every scheduled build so the last result
+// survives restarts of the daemon.
+type daemonRecord struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+
+	flags := daemonCmd.Flags()
+
+	flags.StringVar(&schedule, "schedule", "", "cron expression (e.g. '0 3 * * *' or '@daily') to run builds on")
+	viper.BindPFlag("schedule", flags.Lookup("schedule"))
+
+	flags.BoolVar(&runNow, "now", false, "start a build immediately instead of waiting for the first tick")
+
+	flags.IntVar(&maxParallelBuilds, "parallel", 1, "number of profiles to build at the same time")
+}
+
+func daemonRecordPath() string {
+	return path.Join(stack.StateDir(viper.GetString("statepath")), daemonRecordFile)
+}
+
+func readDaemonRecord() (*daemonRecord, error) {
+	data, err := ioutil.ReadFile(daemonRecordPath())
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &daemonRecord{}
+
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", daemonRecordPath(), err)
+	}
+
+	return record, nil
+}
+
+func writeDaemonRecord(record *daemonRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(path.Dir(daemonRecordPath()), 0700)
+
+	return ioutil.WriteFile(daemonRecordPath(), data, 0600)
+}
+
+func scheduledBuild(ctx context.Context, parallel int) error {
+	config, err := stackConfig()
+
+	if err != nil {
+		return err
+	}
+
+	backends, err := notifiers()
+
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := keysPassphrase(config, false)
+
+	if err != nil {
+		return err
+	}
+
+	c, err := stack.NewDockerStack(config)
+
+	if err != nil {
+		return err
+	}
+
+	targets, err := buildTargets(c, config, "", true)
+
+	if err != nil {
+		shutdown(c)
+		return err
+	}
+
+	return runBuilds(ctx, c, config.Name, targets, stack.BuildOptions{KeysPassphrase: passphrase}, backends, parallel)
+}
+
+func runScheduledBuild(ctx context.Context, parallel int) {
+	record := &daemonRecord{
+		Started: time.Now(),
+	}
+
+	log.Infof("starting scheduled build")
+
+	err := scheduledBuild(ctx, parallel)
+
+	record.Finished = time.Now()
+	record.Success = err == nil
+
+	if err != nil {
+		record.Error = err.Error()
+		log.Errorf("scheduled build failed after %v: %v", record.Finished.Sub(record.Started), err)
+	} else {
+		log.Infof("scheduled build finished after %v", record.Finished.Sub(record.Started))
+	}
+
+	if err := writeDaemonRecord(record); err != nil {
+		log.Warnf("failed to record build result: %v", err)
+	}
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run builds automatically on the configured schedule",
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := deployCheck(cmd, args)
+		if err != nil {
+			return fmt.Errorf("error: stack is not deployed: %v", err)
+		}
+		if viper.GetString("schedule") == "" {
+			return fmt.Errorf("must specify a schedule")
+		}
+		if _, err := cron.ParseStandard(viper.GetString("schedule")); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", viper.GetString("schedule"), err)
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if record, err := readDaemonRecord(); err == nil {
+			log.Infof("last build started %v, success: %v", record.Started.Format(time.RFC1123), record.Success)
+		}
+
+		// a build can easily outlast the interval between ticks, never
+		// start a second one in the same build container
+		c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.PrintfLogger(log.StandardLogger()))))
+
+		parallel := parallelBuilds(cmd)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		id, err := c.AddFunc(viper.GetString("schedule"), func() { runScheduledBuild(ctx, parallel) })
+
+		if err != nil {
+			log.Fatalf("failed to schedule build: %v", err)
+		}
+
+		c.Start()
+
+		log.Infof("next build scheduled for %v", c.Entry(id).Next.Format(time.RFC1123))
+
+		if runNow {
+			go c.Entry(id).WrappedJob.Run()
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		log.Info("stopping running build")
+		cancel()
+		<-c.Stop().Done()
+	},
+}
@@ -3,14 +3,17 @@ package cli
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
-	osuser "os/user"
 	"github.com/manifoldco/promptui"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/devices"
+	"github.io/gnu3ra/localstack/ota"
 	"github.io/gnu3ra/localstack/stack"
 	"github.io/gnu3ra/localstack/utils"
 	yaml "gopkg.in/yaml.v2"
@@ -19,14 +22,19 @@ import (
 
 const minimumChromiumVersion = 80
 
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
 var deployCheck = func(cmd *cobra.Command, args []string) error {
-		if viper.GetString("device") == "" {
-			return errors.New("must specify device type")
+		p, err := profiles()
+
+		if err != nil {
+			return err
 		}
 
-		if viper.GetString("device") == "marlin" || viper.GetString("device") == "sailfish" {
-			log.Warnf("WARNING: marlin/sailfish devices are no longer receiving security updates and will likely be completely deprecated in the future")
+		if viper.GetString("device") == "" && len(p) == 0 {
+			return errors.New("must specify device type")
 		}
+
 		if viper.GetString("chromium-version") != "" {
 			chromiumVersionSplit := strings.Split(viper.GetString("chromium-version"), ".")
 			if len(chromiumVersionSplit) != 4 {
@@ -41,43 +49,127 @@ var deployCheck = func(cmd *cobra.Command, args []string) error {
 			}
 		}
 
+		if viper.GetString("release-url") == "" {
+			log.Warnf("WARNING: release-url is not set, built images will not be able to receive OTA updates")
+		}
+
 		if device == "list" {
-			fmt.Printf("Valid devices are: %v\n", supportDevicesOutput)
+			fmt.Printf("Valid devices are: %v\n", devices.Describe())
 			os.Exit(0)
 		}
-		for _, device := range supportedDevicesCodename {
-			if device == viper.GetString("device") {
-				return nil
+		if d := viper.GetString("device"); d != "" {
+			if _, err := devices.Lookup(d); err != nil {
+				return fmt.Errorf("must specify a supported device: %v", strings.Join(devices.Codenames(), ", "))
+			}
+		}
+		if v := viper.GetString("variant"); v != "" && !ota.ValidVariant(v) {
+			return fmt.Errorf("invalid variant %s, must be one of %s", v, strings.Join(ota.Variants, ", "))
+		}
+		if r := viper.GetString("runtime"); r != "" && !validRuntime(r) {
+			return fmt.Errorf("invalid runtime %s, must be one of %v", r, strings.Join(stack.Runtimes, ", "))
+		}
+		if err := checkPodmanURL(); err != nil {
+			return err
+		}
+		if viper.GetInt("nproc") < 0 {
+			return errors.New("nproc must not be negative")
+		}
+		if viper.GetInt64("pids-limit") < 0 {
+			return errors.New("pids-limit must not be negative")
+		}
+		if _, _, err := memoryLimits(); err != nil {
+			return err
+		}
+		if err := checkKeysConfig(); err != nil {
+			return err
+		}
+		if viper.GetBool("attestation-server") && !commitHash.MatchString(viper.GetString("attestation-commit")) {
+			return errors.New("attestation-server needs attestation-commit, the full hash of a reviewed AttestationServer commit")
+		}
+		return checkProfiles(p)
+	}
+
+func validRuntime(name string) bool {
+	for _, r := range stack.Runtimes {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPodmanURL() error {
+	addr := viper.GetString("podman-url")
+
+	if addr == "" {
+		return nil
+	}
+
+	if r := viper.GetString("runtime"); r != "" && r != "podman" {
+		return fmt.Errorf("podman-url is only used with the podman runtime, not %s", r)
+	}
+
+	u, err := url.Parse(addr)
+
+	if err != nil {
+		return fmt.Errorf("invalid podman-url: %v", err)
+	}
+
+	if u.Scheme == "ssh" {
+		if k := viper.GetString("ssh-key"); k != "" {
+			if _, err := os.Stat(k); err != nil {
+				return fmt.Errorf("ssh-key %s is not readable: %v", k, err)
 			}
 		}
-		return fmt.Errorf("must specify a supported device: %v", strings.Join(supportedDevicesCodename, ", "))
 	}
 
-var name, region, email, device, sshKey, maxPrice, skipPrice, schedule string
+	for _, scheme := range stack.PodmanURLSchemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid podman-url %s, must start with one of %s://", addr, strings.Join(stack.PodmanURLSchemes, ":// or "))
+}
+
+// apply deploys the build environment, the stack is shut down before it
+// returns, also when the deploy is interrupted.
+func apply() error {
+	config, err := stackConfig()
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	s, err := stack.NewDockerStack(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer shutdown(s)
+
+	return s.Apply(ctx)
+}
+
+var name, region, email, device, sshKey, maxPrice, skipPrice, schedule, containerRuntime, podmanURL string
 var instanceType, instanceRegions, hostsFile, chromiumVersion string
 var preventShutdown, encryptedKeys, saveConfig, attestationServer bool
+var attestationPort int
+var attestationCommit string
 var patches = &utils.CustomPatches{}
 var scripts = &utils.CustomScripts{}
 var prebuilts = &utils.CustomPrebuilts{}
 var manifestRemotes = &utils.CustomManifestRemotes{}
 var manifestProjects = &utils.CustomManifestProjects{}
 var trustedRepoBase = "https://github.com/gnu3ra/localstack"
-var supportedDevicesFriendly = []string{"Pixel", "Pixel XL", "Pixel 2", "Pixel 2 XL", "Pixel 3", "Pixel 3 XL", "Pixel 3a", "Pixel 3a XL"}
-var supportedDevicesCodename = []string{"sailfish", "marlin", "walleye", "taimen", "blueline", "crosshatch", "sargo", "bonito"}
-
-
-var supportDevicesOutput string
 
 func init() {
 	rootCmd.AddCommand(deployCmd)
 
-	for i, d := range supportedDevicesCodename {
-		supportDevicesOutput += fmt.Sprintf("%v (%v)", d, supportedDevicesFriendly[i])
-		if i < len(supportedDevicesCodename)-1 {
-			supportDevicesOutput += ", "
-		}
-	}
-
 	flags := deployCmd.Flags()
 	flags.StringVarP(&device, "device", "d", "",
 		"device you want to build for (e.g. crosshatch): to list supported devices use '-d list'")
@@ -88,6 +180,30 @@ func init() {
 			"version of Chromium is used.")
 	viper.BindPFlag("chromium-version", flags.Lookup("chromium-version"))
 
+	flags.BoolVar(&attestationServer, "attestation-server", false,
+		"deploy an Auditor compatible attestation server alongside the build environment")
+	viper.BindPFlag("attestation-server", flags.Lookup("attestation-server"))
+
+	flags.IntVar(&attestationPort, "attestation-port", 8085, "host port the attestation server is published on")
+	viper.BindPFlag("attestation-port", flags.Lookup("attestation-port"))
+
+	flags.StringVar(&attestationCommit, "attestation-commit", "",
+		"full hash of the AttestationServer commit to build the attestation server from")
+	viper.BindPFlag("attestation-commit", flags.Lookup("attestation-commit"))
+
+	flags.BoolVar(&encryptedKeys, "encrypted-keys", false,
+		"seal the signing keys with a passphrase, they are only decrypted into memory while signing")
+	viper.BindPFlag("encrypted-keys", flags.Lookup("encrypted-keys"))
+
+	flags.StringVar(&containerRuntime, "runtime", "podman",
+		"container engine to build with: "+strings.Join(stack.Runtimes, ", "))
+	viper.BindPFlag("runtime", flags.Lookup("runtime"))
+
+	flags.StringVar(&podmanURL, "podman-url", "",
+		"podman service to use (e.g. unix:///run/user/1000/podman/podman.sock or ssh://user@host/run/podman/podman.sock) "+
+			"instead of starting one")
+	viper.BindPFlag("podman-url", flags.Lookup("podman-url"))
+
 	flags.BoolVar(&saveConfig, "save-config", false, "allows you to save all passed CLI flags to config file")
 }
 
@@ -141,48 +257,10 @@ var deployCmd = &cobra.Command{
 			log.Fatalf("Exiting %v", err)
 		}
 
-		u, err := osuser.Current()
-
-		if err != nil {
-			log.Fatalf("failed to get user: %v", err)
-			return
-		}
-
-		s, err := stack.NewDockerStack(&stack.DockerStackConfig{
-			Name:                   viper.GetString("name"),
-			Device:                 viper.GetString("device"),
-			Email:                  viper.GetString("email"),
-			SSHKey:                 viper.GetString("ssh-key"),
-			Schedule:               viper.GetString("schedule"),
-			ChromiumVersion:        viper.GetString("chromium-version"),
-			HostsFile:              viper.GetString("hosts-file"),
-			CustomPatches:          patches,
-			CustomScripts:          scripts,
-			CustomPrebuilts:        prebuilts,
-			CustomManifestRemotes:  manifestRemotes,
-			CustomManifestProjects: manifestProjects,
-			Version:                version,
-			EnableAttestation:      viper.GetBool("attestation-server"),
-			StatePath:              viper.GetString("statepath"),
-			NumProc:                viper.GetInt("nproc"),
-			Uid: 					u.Uid,
-			Gid:					u.Gid,
-		})
-
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		defer shutdown(s)
-
-		if err := s.Apply(); err != nil {
+		if err := apply(); err != nil {
 			log.Fatal(err)
 		}
 
-		if err = s.Shutdown(); err != nil {
-			log.Fatalf("failed to shutdown: %v", err)
-		}
-
 		if saveConfig {
 			log.Printf("Saved settings to config file %v.", configFileFullPath)
 			err := viper.WriteConfigAs(configFileFullPath)
@@ -0,0 +1,543 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/manifoldco/promptui"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/keys"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+const (
+	defaultKeySubject  = "/CN=RattlesnakeOS"
+	defaultKeyRSASize  = 2048
+	defaultAVBRSASize  = 4096
+	defaultKeyValidity = 10000
+)
+
+// keysConfig reads the [keys] section of the config file.
+func keysConfig() (*stack.KeysConfig, error) {
+	k := &stack.KeysConfig{}
+
+	if err := viper.UnmarshalKey("keys", k); err != nil {
+		return nil, fmt.Errorf("failed to parse keys section: %v", err)
+	}
+
+	if k.Subject == "" {
+		k.Subject = defaultKeySubject
+	}
+	if k.RSASize == 0 {
+		k.RSASize = defaultKeyRSASize
+	}
+	if k.AVBRSASize == 0 {
+		k.AVBRSASize = defaultAVBRSASize
+	}
+	if k.Validity == 0 {
+		k.Validity = defaultKeyValidity
+	}
+
+	return k, nil
+}
+
+// checkKeysConfig validates the [keys] section, the subject is rendered into
+// the build script.
+func checkKeysConfig() error {
+	k, err := keysConfig()
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(k.Subject, "/") || strings.ContainsAny(k.Subject, "'\\,\n") {
+		return fmt.Errorf("invalid keys subject %q, expected something like /O=Example/CN=Example", k.Subject)
+	}
+
+	// the sizes avbtool has signing algorithms for
+	for name, size := range map[string]int{"rsa-size": k.RSASize, "avb-rsa-size": k.AVBRSASize} {
+		switch size {
+		case 2048, 4096, 8192:
+		default:
+			return fmt.Errorf("keys %s must be 2048, 4096 or 8192", name)
+		}
+	}
+
+	if k.Validity < 1 {
+		return fmt.Errorf("keys validity must be a positive number of days")
+	}
+
+	if k.KeystorePasswordFile != "" {
+		if _, err := os.Stat(k.KeystorePasswordFile); err != nil {
+			return fmt.Errorf("keystore-password-file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// keysPassphrase returns the passphrase sealing the signing keys, read from
+// keys-passphrase-file or, if interactive, prompted for. It is empty unless
+// encrypted-keys is set.
+func keysPassphrase(config *stack.DockerStackConfig, interactive bool) (string, error) {
+	if !config.EncryptedKeys {
+		return "", nil
+	}
+
+	if passphraseFile := viper.GetString("keys-passphrase-file"); passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+
+		if err != nil {
+			return "", fmt.Errorf("failed to read keys passphrase: %v", err)
+		}
+
+		passphrase := strings.TrimRight(string(data), "\r\n")
+
+		if passphrase == "" {
+			return "", fmt.Errorf("keys passphrase file %s is empty", passphraseFile)
+		}
+
+		return passphrase, nil
+	}
+
+	if !interactive {
+		return "", errors.New("encrypted-keys is set, keys-passphrase-file is needed to build unattended")
+	}
+
+	prompt := promptui.Prompt{
+		Label: "Keys passphrase ",
+		Mask:  '*',
+		Validate: func(input string) error {
+			if input == "" {
+				return errors.New("passphrase can't be empty")
+			}
+			return nil
+		},
+	}
+
+	passphrase, err := prompt.Run()
+
+	if err != nil {
+		return "", fmt.Errorf("prompt failed: %v", err)
+	}
+
+	return passphrase, nil
+}
+
+var keysDir, keysTarget, keysBackupDest string
+var forceImport, rotateAVB, rotateYes bool
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+
+	flags := keysCmd.PersistentFlags()
+
+	flags.StringVar(&keysDir, "dir", "", "keys directory to use instead of the keys volume")
+	flags.StringVar(&keysTarget, "device", "", "profile or device whose keys volume to use, defaults to the configured device")
+
+	keysCmd.AddCommand(keysGenerateCmd, keysListCmd, keysFingerprintCmd, keysExportCmd, keysImportCmd, keysBackupCmd,
+		keysRotateCmd)
+
+	keysImportCmd.Flags().BoolVar(&forceImport, "force", false, "replace existing keys")
+
+	keysRotateCmd.Flags().BoolVar(&rotateAVB, "avb", false,
+		"also replace the AVB key, locked devices won't boot the transition OTA")
+	keysRotateCmd.Flags().BoolVarP(&rotateYes, "yes", "y", false, "don't ask for confirmation")
+
+	keysBackupCmd.Flags().StringVar(&keysBackupDest, "dest", "",
+		"directory to write the backup to, defaults to key-backups in the state directory")
+}
+
+// keysStack starts the stack and returns the stack of the profile selected
+// with --device. Shutting down the first return value stops podman.
+func keysStack() (*stack.DockerStack, *stack.DockerStack, *stack.DockerStackConfig, error) {
+	config, err := stackConfig()
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c, err := stack.NewDockerStack(config)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	targets, err := buildTargets(c, config, keysTarget, false)
+
+	if err != nil {
+		c.Shutdown()
+		return nil, nil, nil, err
+	}
+
+	return c, targets[0], config, nil
+}
+
+// withKeysDir runs fn on the keys directory and the device it belongs to. fn
+// may only change the keys if write is set.
+func withKeysDir(write bool, fn func(dir string, device string) error) error {
+	if keysDir != "" {
+		device := keysTarget
+
+		if device == "" {
+			device = viper.GetString("device")
+		}
+
+		return fn(keysDir, device)
+	}
+
+	c, s, _, err := keysStack()
+
+	if err != nil {
+		return err
+	}
+
+	defer c.Shutdown()
+
+	return s.WithKeysDir(write, func(dir string) error {
+		return fn(dir, s.Device())
+	})
+}
+
+func printFingerprints(dir string, device string) error {
+	prints, err := keys.Fingerprints(dir, device)
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSHA256")
+
+	for _, p := range prints {
+		fmt.Fprintf(w, "%s\t%s\n", p.Name, p.SHA256)
+	}
+
+	return w.Flush()
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the signing keys of the build",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if keysDir == "" && viper.GetString("statepath") == "" {
+			return fmt.Errorf("must specify statepath")
+		}
+		return nil
+	},
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate signing keys for the device if it has none",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if keysDir != "" {
+			log.Fatal("keys are generated in the build container, --dir is not supported")
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		c, s, config, err := keysStack()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer shutdown(c)
+
+		if s != c {
+			defer shutdown(s)
+		}
+
+		passphrase, err := keysPassphrase(config, true)
+
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		err = s.GenerateKeys(ctx, &stack.BuildOptions{KeysPassphrase: passphrase})
+
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		err = s.WithKeysDir(false, func(dir string) error {
+			return printFingerprints(dir, s.Device())
+		})
+
+		if err != nil {
+			log.Error(err)
+		}
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the key sets in the keys volume and the ones key rotations retired",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := withKeysDir(false, func(dir string, device string) error {
+			sets, err := keys.List(dir)
+
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DEVICE\tARCHIVE\tSEALED\tFILES")
+
+			for _, set := range sets {
+				archive := set.Archive
+
+				if archive == "" {
+					archive = "-"
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", set.Device, archive, set.Sealed, strings.Join(set.Files, " "))
+			}
+
+			return w.Flush()
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var keysFingerprintCmd = &cobra.Command{
+	Use:   "fingerprint",
+	Short: "Print the SHA256 of the AVB public key and every certificate",
+	Long: "Print the SHA256 of the AVB public key and every certificate. The avb hash is the one shown " +
+		"by the bootloader and Auditor, check it before flashing avb_pkmd.bin.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := withKeysDir(false, printFingerprints); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var keysExportCmd = &cobra.Command{
+	Use:   "export <file> [device...]",
+	Short: "Export key sets and their retired keys to a gzipped tar, every key set if no device is given",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := withKeysDir(false, func(dir string, device string) error {
+			f, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+			if err != nil {
+				return fmt.Errorf("failed to create export: %v", err)
+			}
+
+			err = keys.Export(dir, f, args[1:]...)
+
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+
+			if err != nil {
+				os.Remove(args[0])
+				return err
+			}
+
+			log.Infof("exported keys to %s", args[0])
+
+			return nil
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var keysImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import key sets exported with keys export or keys backup",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := withKeysDir(true, func(dir string, device string) error {
+			f, err := os.Open(args[0])
+
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			imported, err := keys.Import(dir, f, forceImport)
+
+			if err != nil {
+				return err
+			}
+
+			for _, d := range imported {
+				if strings.HasPrefix(d, keys.ArchiveDir+"/") {
+					log.Infof("restored retired keys %s", d)
+					continue
+				}
+
+				log.Infof("imported keys for %s", d)
+
+				if err := printFingerprints(dir, d); err != nil {
+					log.Warn(err)
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var keysBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Write every key set to a timestamped archive",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dest := keysBackupDest
+
+		if dest == "" {
+			dest = path.Join(stack.StateDir(viper.GetString("statepath")), "key-backups")
+		}
+
+		err := withKeysDir(false, func(dir string, device string) error {
+			name, err := keys.Backup(dir, dest)
+
+			if err != nil {
+				return err
+			}
+
+			log.Infof("backed up keys to %s, keep a copy somewhere else", name)
+
+			return nil
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the signing keys with a build signed for the transition",
+	Long: "Generate a new key set next to the current one and build a release signed with it. The OTA is " +
+		"signed with the old releasekey so devices still accept it. Once the build succeeds the old keys " +
+		"are moved to the archive directory of the keys volume and every later build uses the new keys. " +
+		"A failed rotation is resumed with the same new keys from the step that failed by running rotate again.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := deployCheck(cmd, args); err != nil {
+			return fmt.Errorf("error: stack is not deployed: %v", err)
+		}
+		if keysDir != "" {
+			return fmt.Errorf("keys are rotated in the build container, --dir is not supported")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		color.Yellow("Devices have to install the transition OTA before any later update, " +
+			"devices that miss it have to sideload it. Back up the keys first with 'localstack keys backup'.")
+
+		if rotateAVB {
+			color.Red("Rotating the AVB key: devices with a locked bootloader will refuse to boot the transition OTA " +
+				"and fall back to the old slot. Every device has to be unlocked, which wipes it, and flashed with " +
+				"the new avb_pkmd.bin. Redeploy the attestation server afterwards.")
+		}
+
+		if !rotateYes {
+			prompt := promptui.Prompt{
+				Label:     "Rotate keys",
+				IsConfirm: true,
+			}
+
+			if _, err := prompt.Run(); err != nil {
+				log.Fatal("key rotation aborted")
+			}
+		}
+
+		backends, err := notifiers()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		c, s, config, err := keysStack()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		passphrase, err := keysPassphrase(config, true)
+
+		if err != nil {
+			shutdown(c)
+			log.Fatal(err)
+		}
+
+		published := watchPublished(s.Subscribe())
+
+		err = runBuilds(ctx, c, config.Name, []*stack.DockerStack{s}, stack.BuildOptions{
+			KeysPassphrase: passphrase,
+			Resume:         true,
+			RotateKeys:     true,
+			RotateAVB:      rotateAVB,
+		}, backends, 1)
+
+		if err != nil && <-published {
+			log.Fatalf("key rotation failed after the transition OTA was published, devices that install it "+
+				"only accept builds signed with the new keys. Run 'localstack keys rotate' again to finish it: %v", err)
+		}
+
+		if err != nil {
+			log.Fatalf("key rotation failed, the old keys are still in use: %v", err)
+		}
+
+		log.Info("keys rotated, the new fingerprints are:")
+
+		// runBuilds shut the stack down, look at the keys through a new one
+		if err := withKeysDir(false, printFingerprints); err != nil {
+			log.Warn(err)
+		}
+	},
+}
+
+// watchPublished reports on the returned channel, once events is closed,
+// whether the build published its release: aws_upload finished or was skipped
+// as an earlier attempt already finished it.
+func watchPublished(events <-chan stack.StepEvent) <-chan bool {
+	result := make(chan bool, 1)
+
+	go func() {
+		published := false
+
+		for event := range events {
+			if event.Step == "aws_upload" && (event.Kind == stack.StepFinished || event.Kind == stack.StepSkipped) {
+				published = true
+			}
+		}
+
+		result <- published
+	}()
+
+	return result
+}
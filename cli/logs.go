@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+var followLog, listLogs bool
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+
+	flags := logsCmd.Flags()
+
+	flags.BoolVarP(&followLog, "follow", "f", false, "keep printing output as the build writes it, until the build exits")
+	flags.BoolVarP(&listLogs, "list", "l", false, "list the logs of past builds")
+}
+
+func printBuildLogs() error {
+	logs, err := stack.ListBuildLogs(viper.GetString("statepath"))
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tSIZE")
+
+	for _, l := range logs {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", l.ID, l.Started.Format(time.RFC1123), l.Size)
+	}
+
+	return w.Flush()
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs [id|latest]",
+	Short: "List past builds or print the output of one",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("statepath") == "" {
+			return fmt.Errorf("must specify statepath")
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one build id")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if listLogs {
+			if err := printBuildLogs(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		id := ""
+		if len(args) == 1 {
+			id = args[0]
+		}
+
+		buildLog, err := stack.FindBuildLog(viper.GetString("statepath"), id)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !followLog {
+			f, err := os.Open(buildLog.Path)
+
+			if err != nil {
+				log.Fatalf("failed to open log: %v", err)
+			}
+
+			defer f.Close()
+
+			if _, err := io.Copy(os.Stdout, f); err != nil {
+				log.Fatalf("failed to read log: %v", err)
+			}
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+		go func() {
+			<-sig
+			cancel()
+		}()
+
+		if err := stack.FollowLog(ctx, buildLog.Path, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
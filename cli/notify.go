@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/notify"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+// notifiers returns the notification backends enabled in the config file.
+func notifiers() (notify.Multi, error) {
+	backends := notify.Multi{}
+
+	if email := viper.GetString("email"); email != "" {
+		if viper.GetString("smtp-server") == "" {
+			return nil, fmt.Errorf("email notifications need smtp-server to be set")
+		}
+
+		to := notify.Addresses(email)
+		if len(to) == 0 {
+			return nil, fmt.Errorf("email has no addresses")
+		}
+
+		from := viper.GetString("smtp-from")
+		if from == "" {
+			from = to[0]
+		}
+
+		password := ""
+		if passwordFile := viper.GetString("smtp-password-file"); passwordFile != "" {
+			data, err := ioutil.ReadFile(passwordFile)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to read smtp password: %v", err)
+			}
+
+			password = strings.TrimSpace(string(data))
+		}
+
+		backends = append(backends, &notify.SMTP{
+			Addr:     viper.GetString("smtp-server"),
+			From:     from,
+			To:       to,
+			Username: viper.GetString("smtp-username"),
+			Password: password,
+		})
+	}
+
+	if url := viper.GetString("notify-webhook"); url != "" {
+		backends = append(backends, &notify.Webhook{URL: url})
+	}
+
+	if command := viper.GetString("notify-command"); command != "" {
+		backends = append(backends, &notify.Command{Command: command})
+	}
+
+	return backends, nil
+}
+
+// deliverNotifications forwards the notifications sent by the build script
+// to every configured backend. The returned channel is closed once the
+// event stream ends and everything has been delivered.
+func deliverNotifications(name, device string, backends notify.Multi, events <-chan stack.StepEvent) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for event := range events {
+			if event.Kind != stack.BuildNotify || len(backends) == 0 {
+				continue
+			}
+
+			err := backends.Notify(&notify.Notification{
+				Stack:   name,
+				Device:  device,
+				Status:  notify.Status(event.Status),
+				Message: event.Message,
+				Time:    event.Time,
+			})
+
+			if err != nil {
+				log.Warn(err)
+			}
+		}
+	}()
+
+	return done
+}
@@ -0,0 +1,245 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/devices"
+	"github.io/gnu3ra/localstack/notify"
+	"github.io/gnu3ra/localstack/ota"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+// profiles reads the [[profiles]] tables of the config file, sorted by name.
+func profiles() ([]stack.Profile, error) {
+	var p []stack.Profile
+
+	if err := viper.UnmarshalKey("profiles", &p); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles: %v", err)
+	}
+
+	sort.Slice(p, func(i, j int) bool { return p[i].Name < p[j].Name })
+
+	return p, nil
+}
+
+// checkProfiles validates the configured profiles against each other and
+// the default device.
+func checkProfiles(p []stack.Profile) error {
+	names := map[string]bool{}
+	channels := map[string]string{}
+
+	defaultVariant := viper.GetString("variant")
+	if defaultVariant == "" {
+		defaultVariant = "user"
+	}
+
+	if d := viper.GetString("device"); d != "" {
+		channels[d+"/"+defaultVariant+"/dev"] = "the default profile"
+	}
+
+	for _, profile := range p {
+		if profile.Name == "" {
+			return fmt.Errorf("every profile needs a name")
+		}
+		if !stack.ValidVolumeName(profile.Name) {
+			return fmt.Errorf("invalid profile name %s: only letters, digits, '.', '_' and '-' are allowed", profile.Name)
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("duplicate profile %s", profile.Name)
+		}
+		names[profile.Name] = true
+
+		if _, err := devices.Lookup(profile.Device); err != nil {
+			return fmt.Errorf("profile %s: must specify a supported device: %v", profile.Name, strings.Join(devices.Codenames(), ", "))
+		}
+
+		channel := profile.Channel
+		if channel == "" {
+			channel = "dev"
+		}
+		if !ota.ValidChannel(channel) {
+			return fmt.Errorf("profile %s: channel must be one of %s", profile.Name, strings.Join(ota.Channels, ", "))
+		}
+
+		variant := profile.Variant
+		if variant == "" {
+			variant = defaultVariant
+		}
+		if !ota.ValidVariant(variant) {
+			return fmt.Errorf("profile %s: variant must be one of %s", profile.Name, strings.Join(ota.Variants, ", "))
+		}
+
+		// both would publish the same OTA metadata file
+		key := profile.Device + "/" + variant + "/" + channel
+		if other, ok := channels[key]; ok {
+			return fmt.Errorf("profile %s releases %s %s on the %s channel, as does %s", profile.Name, profile.Device,
+				variant, channel, other)
+		}
+		channels[key] = "profile " + profile.Name
+	}
+
+	return nil
+}
+
+// buildTargets picks the stacks to build: every profile with all, the
+// profile or device named by target, or the default device.
+func buildTargets(root *stack.DockerStack, config *stack.DockerStackConfig, target string, all bool) ([]*stack.DockerStack, error) {
+	targets := []*stack.DockerStack{}
+
+	if all {
+		if config.Device != "" {
+			targets = append(targets, root)
+		}
+
+		for _, p := range config.Profiles {
+			s, err := root.Profile(p.Name)
+
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, s)
+		}
+
+		return targets, nil
+	}
+
+	if target == "" || target == config.Device {
+		if config.Device == "" {
+			return nil, fmt.Errorf("no default device configured, pick a profile with --device")
+		}
+		return append(targets, root), nil
+	}
+
+	name := ""
+
+	for _, p := range config.Profiles {
+		if p.Name == target {
+			name = p.Name
+			break
+		}
+
+		if p.Device == target {
+			if name != "" {
+				return nil, fmt.Errorf("several profiles build %s, pick one by name", target)
+			}
+			name = p.Name
+		}
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("no profile or device named %s", target)
+	}
+
+	s, err := root.Profile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(targets, s), nil
+}
+
+// runBuilds builds every target, at most parallel at a time. Targets sharing
+// a source volume are built one after the other. Once all builds are done or
+// ctx is cancelled, root and the targets are shut down.
+func runBuilds(ctx context.Context, root *stack.DockerStack, name string, targets []*stack.DockerStack, opts stack.BuildOptions,
+	backends notify.Multi, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	concurrent := parallel > 1 && len(targets) > 1
+
+	if concurrent {
+		opts.NoStdin = true
+	}
+
+	groups := map[string][]*stack.DockerStack{}
+	order := []string{}
+
+	for _, s := range targets {
+		if _, ok := groups[s.BuildVolume()]; !ok {
+			order = append(order, s.BuildVolume())
+		}
+		groups[s.BuildVolume()] = append(groups[s.BuildVolume()], s)
+	}
+
+	reporters := []*progressReporter{}
+	delivered := []<-chan struct{}{}
+
+	for _, s := range targets {
+		prefix := ""
+		if len(targets) > 1 {
+			prefix = s.Name()
+		}
+
+		reporters = append(reporters, reportProgress(prefix, s.Subscribe()))
+		delivered = append(delivered, deliverNotifications(name, s.Device(), backends, s.Subscribe()))
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+	slots := make(chan struct{}, parallel)
+
+	for _, volume := range order {
+		wg.Add(1)
+
+		go func(group []*stack.DockerStack) {
+			defer wg.Done()
+
+			for _, s := range group {
+				slots <- struct{}{}
+
+				if len(targets) > 1 {
+					log.Infof("building %s", s.Name())
+				}
+
+				o := opts
+				err := s.Build(ctx, &o)
+
+				<-slots
+
+				if err != nil {
+					log.Errorf("build of %s failed: %v", s.Name(), err)
+
+					mu.Lock()
+					failed = append(failed, s.Name())
+					mu.Unlock()
+				}
+			}
+		}(groups[volume])
+	}
+
+	wg.Wait()
+
+	for _, s := range targets {
+		if s != root {
+			shutdown(s)
+		}
+	}
+
+	shutdown(root)
+
+	for i := range targets {
+		reporters[i].Summary()
+		<-delivered[i]
+	}
+
+	if ctx.Err() != nil {
+		return stack.ErrCancelled
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("build failed for %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
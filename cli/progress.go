@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+type stepResult struct {
+	name     string
+	started  time.Time
+	duration time.Duration
+	failed   bool
+	skipped  bool
+	done     bool
+}
+
+// progressReporter prints build steps as they start and finish and keeps
+// them around for a summary once the build is over.
+type progressReporter struct {
+	// target prefixes every line when several builds share the terminal
+	target string
+	steps  []*stepResult
+	done   chan struct{}
+}
+
+func reportProgress(target string, events <-chan stack.StepEvent) *progressReporter {
+	r := &progressReporter{
+		target: target,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		for event := range events {
+			r.handle(event)
+		}
+	}()
+
+	return r
+}
+
+func (r *progressReporter) handle(event stack.StepEvent) {
+	switch event.Kind {
+	case stack.StepSkipped:
+		r.steps = append(r.steps, &stepResult{name: event.Step, skipped: true, done: true})
+		color.Yellow("%s==> %s skipped", r.prefix(), event.Step)
+	case stack.StepStarted:
+		r.steps = append(r.steps, &stepResult{name: event.Step, started: event.Time})
+		color.Cyan("%s==> %s", r.prefix(), event.Step)
+	case stack.StepFinished, stack.StepFailed:
+		if len(r.steps) == 0 || r.steps[len(r.steps)-1].name != event.Step {
+			return
+		}
+		step := r.steps[len(r.steps)-1]
+		step.duration = event.Time.Sub(step.started)
+		step.failed = event.Kind == stack.StepFailed
+		step.done = true
+		if step.failed {
+			color.Red("%s==> %s failed after %v", r.prefix(), step.name, step.duration)
+		} else {
+			color.Green("%s==> %s finished in %v", r.prefix(), step.name, step.duration)
+		}
+	}
+}
+
+func (r *progressReporter) prefix() string {
+	if r.target == "" {
+		return ""
+	}
+	return "[" + r.target + "] "
+}
+
+// Summary waits for the event stream to close and prints every step with
+// its duration.
+func (r *progressReporter) Summary() {
+	<-r.done
+
+	if len(r.steps) == 0 {
+		return
+	}
+
+	if r.target != "" {
+		fmt.Printf("\n%s:\n", r.target)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tDURATION")
+
+	for _, step := range r.steps {
+		status := "ok"
+		if step.failed {
+			status = "failed"
+		} else if step.skipped {
+			status = "skipped"
+		} else if !step.done {
+			status = "interrupted"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\n", step.name, status, step.duration)
+	}
+
+	w.Flush()
+}
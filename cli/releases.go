@@ -0,0 +1,353 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/fatih/color"
+	"github.com/manifoldco/promptui"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/ota"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+var keepBuilds, keepDays int
+var pruneDryRun, pruneYes bool
+var promoteDevice, promoteVariant, promoteFrom, promoteTo string
+var promoteYes bool
+
+func init() {
+	rootCmd.AddCommand(releasesCmd)
+
+	releasesCmd.AddCommand(releasesListCmd, releasesPruneCmd, releasesPromoteCmd)
+
+	flags := releasesPruneCmd.Flags()
+
+	flags.IntVar(&keepBuilds, "keep-builds", 0, "number of newest releases to keep of every device")
+	viper.BindPFlag("release-keep-builds", flags.Lookup("keep-builds"))
+
+	flags.IntVar(&keepDays, "keep-days", 0, "keep the releases published in the last days")
+	viper.BindPFlag("release-keep-days", flags.Lookup("keep-days"))
+
+	flags.BoolVar(&pruneDryRun, "dry-run", false, "only list the releases that would be removed")
+	flags.BoolVarP(&pruneYes, "yes", "y", false, "don't ask for confirmation")
+
+	flags = releasesPromoteCmd.Flags()
+
+	flags.StringVar(&promoteDevice, "device", "",
+		"device or profile of the build, only needed if several devices have a build with that number")
+	flags.StringVar(&promoteVariant, "variant", "user", "build variant of the build")
+	flags.StringVar(&promoteFrom, "from", "", "promote the build this channel points at")
+	flags.StringVar(&promoteTo, "to", "",
+		"channel to point at the build, defaults to the one after --from or the one the build was made for")
+	flags.BoolVarP(&promoteYes, "yes", "y", false, "don't ask for confirmation")
+}
+
+// releaseChannels returns the channels pointing devices at r.
+func releaseChannels(releasePath string, r *stack.Release) []string {
+	channels := []string{}
+
+	for _, c := range ota.Channels {
+		build, err := stack.PublishedBuild(releasePath, r, c)
+
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+
+		if build == r.Build {
+			channels = append(channels, c)
+		}
+	}
+
+	return channels
+}
+
+func printReleases(releasePath string, releases []stack.Release) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tVARIANT\tBUILD\tAOSP\tCHROMIUM\tF-DROID\tPUBLISHED\tSIZE\tCHANNELS")
+
+	for i := range releases {
+		r := &releases[i]
+
+		channels := strings.Join(releaseChannels(releasePath, r), ",")
+		if channels == "" {
+			channels = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Device, r.BuildVariant(), r.Build, r.AOSPBuild, r.Chromium,
+			r.FDroidClient, r.PublishedAt().Format(time.RFC1123), units.HumanSize(float64(r.Size())), channels)
+	}
+
+	return w.Flush()
+}
+
+// pruneReleases removes the releases the retention policy doesn't keep.
+func pruneReleases() error {
+	releasePath := stack.ReleasePath(viper.GetString("statepath"))
+	releases, err := stack.Releases(releasePath)
+
+	if err != nil {
+		return err
+	}
+
+	policy := &stack.RetentionPolicy{
+		KeepBuilds: viper.GetInt("release-keep-builds"),
+		KeepDays:   viper.GetInt("release-keep-days"),
+	}
+
+	expired, err := policy.Expired(releasePath, releases, time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	if len(expired) == 0 {
+		log.Info("no releases to prune")
+		return nil
+	}
+
+	if err := printReleases(releasePath, expired); err != nil {
+		return err
+	}
+
+	if pruneDryRun {
+		return nil
+	}
+
+	if !pruneYes {
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("Remove %d releases", len(expired)),
+			IsConfirm: true,
+		}
+
+		if _, err := prompt.Run(); err != nil {
+			return fmt.Errorf("prune aborted")
+		}
+	}
+
+	config, err := stackConfig()
+
+	if err != nil {
+		return err
+	}
+
+	s, err := stack.NewDockerStack(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer shutdown(s)
+
+	return s.PruneReleases(expired)
+}
+
+// promoteTarget returns the release to promote and the channel to point at
+// it, from the build number or the --from channel.
+func promoteTarget(releasePath string, releases []stack.Release, build string) (*stack.Release, string, error) {
+	if promoteFrom == "" {
+		r, err := stack.FindRelease(releases, promoteDevice, promoteVariant, build)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		if promoteTo == "" {
+			return r, r.Channel, nil
+		}
+
+		return r, promoteTo, nil
+	}
+
+	if !ota.ValidChannel(promoteFrom) {
+		return nil, "", fmt.Errorf("invalid channel %s, must be one of %s", promoteFrom, strings.Join(ota.Channels, ", "))
+	}
+
+	r, err := stack.ChannelRelease(releasePath, releases, promoteDevice, promoteVariant, promoteFrom)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if build != "" && build != r.Build {
+		return nil, "", fmt.Errorf("the %s channel of %s points at build %s, not %s", promoteFrom, r.Device, r.Build, build)
+	}
+
+	if promoteTo == "" {
+		if next := ota.NextChannel(promoteFrom); next != "" {
+			return r, next, nil
+		}
+		return nil, "", fmt.Errorf("%s is the last channel, pass --to", promoteFrom)
+	}
+
+	return r, promoteTo, nil
+}
+
+// promoteRelease points a channel at an older or newer build of its device.
+func promoteRelease(build string) error {
+	releasePath := stack.ReleasePath(viper.GetString("statepath"))
+	releases, err := stack.Releases(releasePath)
+
+	if err != nil {
+		return err
+	}
+
+	r, channel, err := promoteTarget(releasePath, releases, build)
+
+	if err != nil {
+		return err
+	}
+
+	if !ota.ValidChannel(channel) {
+		return fmt.Errorf("invalid channel %s, must be one of %s", channel, strings.Join(ota.Channels, ", "))
+	}
+
+	current, err := stack.PublishedBuild(releasePath, r, channel)
+
+	if err != nil {
+		return err
+	}
+
+	if current == r.Build {
+		log.Infof("%s channel of %s already points at build %s", channel, r.Device, r.Build)
+		return nil
+	}
+
+	if c, err := stack.FindRelease(releases, r.Device, promoteVariant, current); err == nil && c.Timestamp > r.Timestamp {
+		color.Yellow(fmt.Sprintf("Build %s is older than build %s on the %s channel. Only devices that have not "+
+			"installed %s yet get %s, the Updater app never offers a build older than the one a device runs.",
+			r.Build, current, channel, current, r.Build))
+
+		if c.AOSPBuild != r.AOSPBuild {
+			color.Red(fmt.Sprintf("Build %s is based on %s, build %s on %s. If the security patch level went "+
+				"up, so did the AVB rollback index: devices with a locked bootloader that ran %s refuse to boot "+
+				"%s even when it is sideloaded. Fix those devices with a newer build instead.",
+				r.Build, r.AOSPBuild, current, c.AOSPBuild, current, r.Build))
+		}
+	}
+
+	if !promoteYes {
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("Point the %s channel of %s at build %s", channel, r.Device, r.Build),
+			IsConfirm: true,
+		}
+
+		if _, err := prompt.Run(); err != nil {
+			return fmt.Errorf("promote aborted")
+		}
+	}
+
+	config, err := stackConfig()
+
+	if err != nil {
+		return err
+	}
+
+	s, err := stack.NewDockerStack(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer shutdown(s)
+
+	return s.PromoteRelease(r, channel)
+}
+
+var releasesCmd = &cobra.Command{
+	Use:   "releases",
+	Short: "Manage the builds published to the release directory",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("statepath") == "" {
+			return fmt.Errorf("must specify statepath")
+		}
+		return nil
+	},
+}
+
+var releasesListCmd = &cobra.Command{
+	Use:   "list [device]",
+	Short: "List the published builds, oldest first",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		releasePath := stack.ReleasePath(viper.GetString("statepath"))
+		releases, err := stack.Releases(releasePath)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(args) == 1 {
+			device := []stack.Release{}
+
+			for _, r := range releases {
+				if r.Device == args[0] {
+					device = append(device, r)
+				}
+			}
+
+			releases = device
+		}
+
+		if len(releases) == 0 {
+			fmt.Println("no releases")
+			return
+		}
+
+		if err := printReleases(releasePath, releases); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var releasesPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the releases the retention policy doesn't keep",
+	Long: "Remove the OTA updates and factory images of old releases. A release is kept if it is one of the " +
+		"newest --keep-builds of its device or was published in the last --keep-days, and always while a " +
+		"channel points devices at it.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pruneReleases(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var releasesPromoteCmd = &cobra.Command{
+	Use:   "promote [build]",
+	Short: "Point a release channel at a build that was published before",
+	Long: "Rewrite the channel metadata and -true-timestamp to point at a retained build without rebuilding " +
+		"it. With --from the build a channel points at is promoted to the next one, dev to beta to stable. " +
+		"Given an older build it rolls a channel back after a broken release, devices that already installed " +
+		"a newer build stay on it.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one build")
+		}
+		if !ota.ValidVariant(promoteVariant) {
+			return fmt.Errorf("invalid variant %s, must be one of %s", promoteVariant, strings.Join(ota.Variants, ", "))
+		}
+		if len(args) == 0 && promoteFrom == "" {
+			return fmt.Errorf("expected a build or --from")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		build := ""
+		if len(args) == 1 {
+			build = args[0]
+		}
+
+		if err := promoteRelease(build); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
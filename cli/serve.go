@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/ota"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+var serveListen, serveTLSCert, serveTLSKey string
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	flags := serveCmd.Flags()
+
+	flags.StringVarP(&serveListen, "listen", "l", ":8080", "address to listen on for OTA update requests")
+	viper.BindPFlag("serve-listen", flags.Lookup("listen"))
+
+	flags.StringVar(&serveTLSCert, "tls-cert", "", "certificate file to serve OTA updates over https")
+	viper.BindPFlag("serve-tls-cert", flags.Lookup("tls-cert"))
+
+	flags.StringVar(&serveTLSKey, "tls-key", "", "private key file matching --tls-cert")
+	viper.BindPFlag("serve-tls-key", flags.Lookup("tls-key"))
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve OTA updates from the release directory to the Updater app",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("statepath") == "" {
+			return fmt.Errorf("must specify statepath")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		releasePath := stack.ReleasePath(viper.GetString("statepath"))
+
+		if viper.GetString("release-url") == "" {
+			log.Warnf("release-url is not set, built images will not know where to find this server")
+		}
+
+		s, err := ota.NewServer(releasePath, viper.GetString("serve-listen"),
+			viper.GetString("serve-tls-cert"), viper.GetString("serve-tls-key"))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := s.ListenAndServe(); err != nil {
+			log.Fatalf("OTA server failed: %v", err)
+		}
+	},
+}
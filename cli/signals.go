@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// signalContext returns a context cancelled by the first SIGINT or SIGTERM.
+// Later signals get the default handling again, so a second Ctrl-C still
+// kills a shutdown that hangs.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case s := <-sig:
+			log.Warnf("received %v, stopping", s)
+			cancel()
+		case <-ctx.Done():
+		}
+
+		signal.Stop(sig)
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.io/gnu3ra/localstack/stack"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+func buildState(status *stack.BuildStatus) string {
+	if status.Running {
+		return "running"
+	}
+	if status.ExitCode == 0 {
+		return "finished"
+	}
+	return fmt.Sprintf("failed (%d)", status.ExitCode)
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [profile]",
+	Short: "Show the progress of detached builds",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("statepath") == "" {
+			return fmt.Errorf("must specify statepath")
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one profile")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		statePath := viper.GetString("statepath")
+		builds, err := stack.DetachedBuilds(statePath)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(args) == 1 {
+			b, err := stack.FindDetachedBuild(statePath, args[0])
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			builds = []stack.DetachedBuild{*b}
+		}
+
+		if len(builds) == 0 {
+			fmt.Println("no detached builds")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tBUILD\tSTATE\tSTEP\tELAPSED")
+
+		for _, b := range builds {
+			status, err := b.Status(statePath)
+
+			if err != nil {
+				log.Warnf("failed to read status of %s: %v", b.ID, err)
+				continue
+			}
+
+			step := status.Step
+			if step == "" {
+				step = "-"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", b.Target, b.ID, buildState(status), step,
+				b.Elapsed(status).Round(time.Second))
+		}
+
+		w.Flush()
+	},
+}
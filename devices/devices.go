@@ -0,0 +1,181 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Device describes everything the build needs to know about one supported
+// device.
+type Device struct {
+	// Codename is the AOSP device name, e.g. bonito
+	Codename string
+	// Friendly is the marketing name shown to users, e.g. Pixel 3a XL
+	Friendly string
+	// Family is the device tree under device/google the device is built from
+	Family string
+	// AVBMode selects how vbmeta is signed in release()
+	AVBMode string
+	// ExtraOTA are extra arguments passed to ota_from_target_files
+	ExtraOTA []string
+	// ModelName replaces "AOSP on <codename>" as PRODUCT_MODEL
+	ModelName string
+	// AttestationName is the AttestationServer DeviceInfo constant
+	AttestationName string
+	// AttestationVersion and KeymasterVersion are the DeviceInfo versions
+	// the AttestationServer expects for this device
+	AttestationVersion int
+	KeymasterVersion   int
+}
+
+const (
+	avbSimple    = "vbmeta_simple"
+	avbChained   = "vbmeta_chained"
+	avbChainedV2 = "vbmeta_chained_v2"
+)
+
+var retrofitDynamicPartitions = []string{"--retrofit_dynamic_partitions"}
+
+// Supported lists every device the build script can build, in the order they
+// are shown to users.
+var Supported = []Device{
+	{
+		Codename:           "walleye",
+		Friendly:           "Pixel 2",
+		Family:             "muskie",
+		AVBMode:            avbSimple,
+		ModelName:          "Pixel 2",
+		AttestationName:    "DEVICE_PIXEL_2",
+		AttestationVersion: 2,
+		KeymasterVersion:   3,
+	},
+	{
+		Codename:           "taimen",
+		Friendly:           "Pixel 2 XL",
+		Family:             "taimen",
+		AVBMode:            avbSimple,
+		ModelName:          "Pixel 2 XL",
+		AttestationName:    "DEVICE_PIXEL_2_XL",
+		AttestationVersion: 2,
+		KeymasterVersion:   3,
+	},
+	{
+		Codename:           "blueline",
+		Friendly:           "Pixel 3",
+		Family:             "crosshatch",
+		AVBMode:            avbChained,
+		ExtraOTA:           retrofitDynamicPartitions,
+		ModelName:          "Pixel 3",
+		AttestationName:    "DEVICE_PIXEL_3",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+	{
+		Codename:           "crosshatch",
+		Friendly:           "Pixel 3 XL",
+		Family:             "crosshatch",
+		AVBMode:            avbChained,
+		ExtraOTA:           retrofitDynamicPartitions,
+		ModelName:          "Pixel 3 XL",
+		AttestationName:    "DEVICE_PIXEL_3_XL",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+	{
+		Codename:           "sargo",
+		Friendly:           "Pixel 3a",
+		Family:             "bonito",
+		AVBMode:            avbChained,
+		ExtraOTA:           retrofitDynamicPartitions,
+		ModelName:          "Pixel 3a",
+		AttestationName:    "DEVICE_PIXEL_3A",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+	{
+		Codename:           "bonito",
+		Friendly:           "Pixel 3a XL",
+		Family:             "bonito",
+		AVBMode:            avbChained,
+		ExtraOTA:           retrofitDynamicPartitions,
+		ModelName:          "Pixel 3a XL",
+		AttestationName:    "DEVICE_PIXEL_3A_XL",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+	{
+		Codename:           "flame",
+		Friendly:           "Pixel 4",
+		Family:             "coral",
+		AVBMode:            avbChainedV2,
+		ModelName:          "Pixel 4",
+		AttestationName:    "DEVICE_PIXEL_4",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+	{
+		Codename:           "coral",
+		Friendly:           "Pixel 4 XL",
+		Family:             "coral",
+		AVBMode:            avbChainedV2,
+		ModelName:          "Pixel 4 XL",
+		AttestationName:    "DEVICE_PIXEL_4_XL",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+	{
+		Codename:           "sunfish",
+		Friendly:           "Pixel 4a",
+		Family:             "sunfish",
+		AVBMode:            avbChainedV2,
+		ModelName:          "Pixel 4A",
+		AttestationName:    "DEVICE_PIXEL_4A",
+		AttestationVersion: 3,
+		KeymasterVersion:   4,
+	},
+}
+
+// Lookup returns the device with the given codename.
+func Lookup(codename string) (*Device, error) {
+	for i := range Supported {
+		if Supported[i].Codename == codename {
+			return &Supported[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported device %s, supported devices are: %s", codename, strings.Join(Codenames(), ", "))
+}
+
+// Codenames returns the codenames of all supported devices.
+func Codenames() []string {
+	names := make([]string, len(Supported))
+
+	for i, d := range Supported {
+		names[i] = d.Codename
+	}
+
+	return names
+}
+
+// Describe lists the supported devices for users, e.g.
+// "walleye (Pixel 2), taimen (Pixel 2 XL), ..."
+func Describe() string {
+	descriptions := make([]string, len(Supported))
+
+	for i, d := range Supported {
+		descriptions[i] = fmt.Sprintf("%v (%v)", d.Codename, d.Friendly)
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+// MakefilePath returns the product makefile of the device relative to the
+// AOSP tree.
+func (d Device) MakefilePath() string {
+	return fmt.Sprintf("device/google/%s/aosp_%s.mk", d.Family, d.Codename)
+}
+
+// ExtraOTAArgs renders ExtraOTA as the contents of a bash array.
+func (d Device) ExtraOTAArgs() string {
+	return strings.Join(d.ExtraOTA, " ")
+}
@@ -0,0 +1,310 @@
+package keys
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Export writes the keys of the given devices as a gzipped tar to w, with the
+// sets key rotations retired into ArchiveDir. Every device is exported if
+// none are given.
+func Export(dir string, w io.Writer, devices ...string) error {
+	sets, err := List(dir)
+
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+
+	for _, device := range devices {
+		wanted[device] = false
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, set := range sets {
+		if _, ok := wanted[set.Device]; len(devices) > 0 && !ok {
+			continue
+		}
+
+		wanted[set.Device] = true
+
+		if set.Sealed {
+			if err := addFile(tw, dir, set.Path()+SealedSuffix); err != nil {
+				return err
+			}
+		}
+
+		for _, f := range set.Files {
+			if err := addFile(tw, dir, path.Join(set.Path(), f)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, device := range devices {
+		if !wanted[device] {
+			return fmt.Errorf("no keys for %s", device)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func addFile(tw *tar.Writer, dir string, name string) error {
+	f, err := os.Open(path.Join(dir, name))
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to archive %s: %v", name, err)
+	}
+
+	_, err = io.Copy(tw, f)
+
+	return err
+}
+
+// importSet returns the key set an archive entry belongs to, as the device
+// and the directory in ArchiveDir it was retired to, if any. ok is false for
+// names Export never writes.
+func importSet(name string) (device string, archive string, ok bool) {
+	parts := strings.Split(name, "/")
+
+	for _, p := range parts {
+		if p == "" || strings.HasPrefix(p, ".") {
+			return "", "", false
+		}
+	}
+
+	if parts[0] == ArchiveDir {
+		if len(parts) < 3 {
+			return "", "", false
+		}
+
+		archive = parts[1]
+		parts = parts[2:]
+	}
+
+	switch {
+	case len(parts) == 1 && strings.HasSuffix(parts[0], SealedSuffix):
+		return strings.TrimSuffix(parts[0], SealedSuffix), archive, true
+	case len(parts) == 2 && parts[0] != ArchiveDir:
+		return parts[0], archive, true
+	}
+
+	return "", "", false
+}
+
+// Import unpacks an archive written by Export into dir and returns the key
+// sets it held, as their path in dir. Existing keys are only replaced with
+// force. The archive is unpacked and checked in a staging directory first, so
+// a bad archive never touches the keys in dir.
+func Import(dir string, r io.Reader, force bool) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+
+	if err != nil {
+		return nil, fmt.Errorf("not a key archive: %v", err)
+	}
+
+	defer gz.Close()
+
+	staging, err := ioutil.TempDir(dir, stagingPrefix)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+
+	defer os.RemoveAll(staging)
+
+	tr := tar.NewReader(gz)
+	sets := []string{}
+	seen := map[string]bool{}
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key archive: %v", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.Clean(header.Name)
+		device, archive, ok := importSet(name)
+
+		if filepath.IsAbs(name) || !ok {
+			return nil, fmt.Errorf("refusing to import %s", header.Name)
+		}
+
+		set := (&KeySet{Device: device, Archive: archive}).Path()
+
+		if !seen[set] {
+			if Exists(path.Join(dir, path.Dir(set)), device) && !force {
+				return nil, fmt.Errorf("keys for %s already exist", set)
+			}
+
+			seen[set] = true
+			sets = append(sets, set)
+		}
+
+		if err := unpackFile(tr, path.Join(staging, name)); err != nil {
+			return nil, fmt.Errorf("failed to import %s: %v", name, err)
+		}
+	}
+
+	// never mix the files of two key sets, the sealed archive and the
+	// directory of a device are replaced together
+	names := []string{}
+
+	for _, set := range sets {
+		names = append(names, set, set+SealedSuffix)
+	}
+
+	if err := swapIn(dir, staging, names); err != nil {
+		return nil, err
+	}
+
+	return sets, nil
+}
+
+func unpackFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(path.Dir(target), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// swapIn replaces names in dir with the ones in staging by renaming them.
+// Names staging doesn't have are removed from dir. The replaced files are
+// moved aside into staging and put back if a rename fails.
+func swapIn(dir string, staging string, names []string) error {
+	old := path.Join(staging, ".old")
+
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+
+	moved := []string{}
+	swapped := []string{}
+
+	restore := func() {
+		for _, name := range swapped {
+			os.Rename(path.Join(dir, name), path.Join(staging, name))
+		}
+
+		for _, name := range moved {
+			os.Rename(path.Join(old, name), path.Join(dir, name))
+		}
+	}
+
+	for _, name := range names {
+		for _, parent := range []string{path.Dir(path.Join(old, name)), path.Dir(path.Join(dir, name))} {
+			if err := os.MkdirAll(parent, 0700); err != nil {
+				restore()
+				return err
+			}
+		}
+
+		if _, err := os.Lstat(path.Join(dir, name)); err == nil {
+			if err := os.Rename(path.Join(dir, name), path.Join(old, name)); err != nil {
+				restore()
+				return fmt.Errorf("failed to replace %s: %v", name, err)
+			}
+
+			moved = append(moved, name)
+		}
+
+		if _, err := os.Lstat(path.Join(staging, name)); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := os.Rename(path.Join(staging, name), path.Join(dir, name)); err != nil {
+			restore()
+			return fmt.Errorf("failed to replace %s: %v", name, err)
+		}
+
+		swapped = append(swapped, name)
+	}
+
+	return nil
+}
+
+// Backup exports every key set in dir to a timestamped archive in dest and
+// returns its path.
+func Backup(dir string, dest string) (string, error) {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return "", err
+	}
+
+	name := path.Join(dest, "localstack-keys-"+time.Now().Format("2006-01-02_15-04-05")+".tar.gz")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %v", err)
+	}
+
+	err = Export(dir, f)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+
+	return name, nil
+}
@@ -0,0 +1,252 @@
+package keys
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testDir(t *testing.T, files ...string) string {
+	dir, err := ioutil.TempDir("", "localstack-keys")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for _, name := range files {
+		if err := os.MkdirAll(path.Join(dir, path.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// testArchive returns a key archive holding names, every file containing its
+// own name.
+func testArchive(t *testing.T, names ...string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(name)), Typeflag: tar.TypeReg}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+// files returns the files below dir, relative to it.
+func files(t *testing.T, dir string) string {
+	names := []string{}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			names = append(names, strings.TrimPrefix(p, dir+"/"))
+		}
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func TestImportRefusesPaths(t *testing.T) {
+	for _, name := range []string{
+		"../releasekey.pk8",
+		"crosshatch/../../releasekey.pk8",
+		"/crosshatch/releasekey.pk8",
+		"crosshatch/nested/releasekey.pk8",
+		".import-1/crosshatch/releasekey.pk8",
+		"archive/crosshatch/releasekey.pk8",
+		"archive/crosshatch-1/../../../releasekey.pk8",
+		"archive/.import-1/crosshatch/releasekey.pk8",
+		"archive/crosshatch-2020.10.17.03/crosshatch/nested/releasekey.pk8",
+	} {
+		dir := testDir(t, "crosshatch/releasekey.pk8")
+
+		// the refused entry comes after a valid one for the existing set
+		archive := testArchive(t, "crosshatch/platform.pk8", name)
+
+		if _, err := Import(dir, archive, true); err == nil {
+			t.Errorf("imported %s", name)
+		}
+
+		if got := files(t, dir); got != "crosshatch/releasekey.pk8" {
+			t.Errorf("keys after refusing %s are %s, want the existing ones", name, got)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		archive  []string
+		force    bool
+		err      bool
+		devices  string
+		want     string
+	}{
+		{
+			name:    "new keys",
+			archive: []string{"crosshatch/releasekey.pk8", "crosshatch/releasekey.x509.pem"},
+			devices: "crosshatch",
+			want:    "crosshatch/releasekey.pk8,crosshatch/releasekey.x509.pem",
+		},
+		{
+			name:     "existing keys without force",
+			existing: []string{"crosshatch/old.pk8"},
+			archive:  []string{"crosshatch/releasekey.pk8"},
+			err:      true,
+			want:     "crosshatch/old.pk8",
+		},
+		{
+			name:     "later device exists without force",
+			existing: []string{"sargo/old.pk8"},
+			archive:  []string{"crosshatch/releasekey.pk8", "sargo/releasekey.pk8"},
+			err:      true,
+			want:     "sargo/old.pk8",
+		},
+		{
+			name:     "existing keys with force",
+			existing: []string{"crosshatch/old.pk8", "crosshatch.tar.gpg", "sargo/releasekey.pk8"},
+			archive:  []string{"crosshatch/releasekey.pk8"},
+			force:    true,
+			devices:  "crosshatch",
+			want:     "crosshatch/releasekey.pk8,sargo/releasekey.pk8",
+		},
+		{
+			name:     "sealed keys with force",
+			existing: []string{"crosshatch/releasekey.pk8", "crosshatch/releasekey.x509.pem"},
+			archive:  []string{"crosshatch.tar.gpg", "crosshatch/releasekey.x509.pem"},
+			force:    true,
+			devices:  "crosshatch",
+			want:     "crosshatch.tar.gpg,crosshatch/releasekey.x509.pem",
+		},
+		{
+			name:    "archived keys",
+			archive: []string{"crosshatch/releasekey.pk8", "archive/crosshatch-1/crosshatch/releasekey.pk8"},
+			devices: "crosshatch,archive/crosshatch-1/crosshatch",
+			want:    "archive/crosshatch-1/crosshatch/releasekey.pk8,crosshatch/releasekey.pk8",
+		},
+		{
+			name:     "existing archived keys without force",
+			existing: []string{"archive/crosshatch-1/crosshatch.tar.gpg"},
+			archive:  []string{"archive/crosshatch-1/crosshatch.tar.gpg"},
+			err:      true,
+			want:     "archive/crosshatch-1/crosshatch.tar.gpg",
+		},
+		{
+			name:     "existing archived keys with force",
+			existing: []string{"archive/crosshatch-1/crosshatch.tar.gpg", "archive/crosshatch-2/crosshatch.tar.gpg"},
+			archive:  []string{"archive/crosshatch-1/crosshatch/releasekey.pk8"},
+			force:    true,
+			devices:  "archive/crosshatch-1/crosshatch",
+			want:     "archive/crosshatch-1/crosshatch/releasekey.pk8,archive/crosshatch-2/crosshatch.tar.gpg",
+		},
+	}
+
+	for _, test := range tests {
+		dir := testDir(t, test.existing...)
+		devices, err := Import(dir, testArchive(t, test.archive...), test.force)
+
+		if test.err != (err != nil) {
+			t.Errorf("%s: Import returned %v", test.name, err)
+		}
+
+		if got := strings.Join(devices, ","); got != test.devices {
+			t.Errorf("%s: imported %s, want %s", test.name, got, test.devices)
+		}
+
+		if got := files(t, dir); got != test.want {
+			t.Errorf("%s: keys are %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := testDir(t, "crosshatch/releasekey.pk8", "crosshatch/releasekey.x509.pem", "sargo.tar.gpg",
+		"sargo/releasekey.x509.pem", "archive/sargo-2020.10.17.03/sargo.tar.gpg",
+		"archive/sargo-2020.10.17.03/sargo/releasekey.x509.pem")
+	archive := &bytes.Buffer{}
+
+	if err := Export(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := testDir(t)
+	devices, err := Import(dest, archive, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "crosshatch,sargo,archive/sargo-2020.10.17.03/sargo"
+
+	if got := strings.Join(devices, ","); got != want {
+		t.Errorf("imported %s, want %s", got, want)
+	}
+
+	if got, want := files(t, dest), files(t, src); got != want {
+		t.Errorf("imported %s, want %s", got, want)
+	}
+}
+
+func TestExportDevice(t *testing.T) {
+	src := testDir(t, "crosshatch/releasekey.pk8", "sargo/releasekey.pk8",
+		"archive/sargo-1/sargo/releasekey.pk8", "archive/crosshatch-1/crosshatch/releasekey.pk8")
+	archive := &bytes.Buffer{}
+
+	if err := Export(src, archive, "sargo"); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := testDir(t)
+
+	if _, err := Import(dest, archive, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := files(t, dest), "archive/sargo-1/sargo/releasekey.pk8,sargo/releasekey.pk8"; got != want {
+		t.Errorf("exported %s, want %s", got, want)
+	}
+
+	if err := Export(src, &bytes.Buffer{}, "bonito"); err == nil {
+		t.Error("exported keys of a device without keys")
+	}
+}
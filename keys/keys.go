@@ -0,0 +1,203 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	certSuffix = ".x509.pem"
+	// SealedSuffix is appended to the device for the encrypted key archive
+	// written in encrypted-keys mode.
+	SealedSuffix = ".tar.gpg"
+	// AVBPublicKey is the public part of the AVB key, flashed with
+	// fastboot flash avb_custom_key.
+	AVBPublicKey = "avb_pkmd.bin"
+	// ArchiveDir holds the keys replaced by a key rotation.
+	ArchiveDir = "archive"
+	// RotationSuffix is appended to the device for the new keys of a key
+	// rotation in progress.
+	RotationSuffix = ".new"
+	// stagingPrefix starts the directories Import unpacks archives into
+	stagingPrefix = ".import-"
+)
+
+// KeySet is the signing keys of a single device in the keys directory.
+type KeySet struct {
+	Device string
+	// Archive is the directory in ArchiveDir holding the set if a key
+	// rotation retired it, empty for the current keys
+	Archive string
+	// Sealed is set if the private keys are encrypted
+	Sealed bool
+	Files  []string
+}
+
+// Path returns the path of the directory of set, relative to the keys
+// directory. The sealed archive is this path with SealedSuffix.
+func (set *KeySet) Path() string {
+	if set.Archive != "" {
+		return path.Join(ArchiveDir, set.Archive, set.Device)
+	}
+	return set.Device
+}
+
+// Fingerprint is the SHA256 of a certificate or public key.
+type Fingerprint struct {
+	Name   string
+	SHA256 string
+}
+
+// List returns the key sets in dir and the retired ones in its ArchiveDir,
+// sorted by device with the current keys first.
+func List(dir string) ([]KeySet, error) {
+	sets := map[string]*KeySet{}
+
+	if err := listSets(dir, "", sets); err != nil {
+		return nil, err
+	}
+
+	archives, err := ioutil.ReadDir(path.Join(dir, ArchiveDir))
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read archived keys: %v", err)
+	}
+
+	for _, a := range archives {
+		if a.IsDir() {
+			if err := listSets(path.Join(dir, ArchiveDir, a.Name()), a.Name(), sets); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := []KeySet{}
+
+	for _, set := range sets {
+		result = append(result, *set)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Device != result[j].Device {
+			return result[i].Device < result[j].Device
+		}
+		return result[i].Archive < result[j].Archive
+	})
+
+	return result, nil
+}
+
+// listSets adds the key sets in dir to sets, archive is the directory in
+// ArchiveDir dir is, if any.
+func listSets(dir string, archive string, sets map[string]*KeySet) error {
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return fmt.Errorf("failed to read keys directory: %v", err)
+	}
+
+	get := func(device string) *KeySet {
+		key := path.Join(archive, device)
+		if _, ok := sets[key]; !ok {
+			sets[key] = &KeySet{Device: device, Archive: archive}
+		}
+		return sets[key]
+	}
+
+	for _, f := range files {
+		if (archive == "" && f.IsDir() && f.Name() == ArchiveDir) || strings.HasPrefix(f.Name(), stagingPrefix) {
+			continue
+		}
+
+		if f.IsDir() {
+			names, err := ioutil.ReadDir(path.Join(dir, f.Name()))
+
+			if err != nil {
+				return fmt.Errorf("failed to read keys of %s: %v", f.Name(), err)
+			}
+
+			set := get(f.Name())
+
+			for _, n := range names {
+				if !n.IsDir() {
+					set.Files = append(set.Files, n.Name())
+				}
+			}
+		} else if strings.HasSuffix(f.Name(), SealedSuffix) {
+			get(strings.TrimSuffix(f.Name(), SealedSuffix)).Sealed = true
+		}
+	}
+
+	return nil
+}
+
+// Fingerprints returns the SHA256 of every certificate of device, and of the
+// AVB public key as shown by Auditor and the bootloader.
+func Fingerprints(dir string, device string) ([]Fingerprint, error) {
+	deviceDir := path.Join(dir, device)
+	files, err := ioutil.ReadDir(deviceDir)
+
+	if err != nil {
+		return nil, fmt.Errorf("no keys for %s: %v", device, err)
+	}
+
+	prints := []Fingerprint{}
+
+	for _, f := range files {
+		name := f.Name()
+
+		switch {
+		case name == AVBPublicKey:
+			data, err := ioutil.ReadFile(path.Join(deviceDir, name))
+
+			if err != nil {
+				return nil, err
+			}
+
+			prints = append(prints, Fingerprint{Name: "avb", SHA256: digest(data)})
+		case strings.HasSuffix(name, certSuffix):
+			data, err := ioutil.ReadFile(path.Join(deviceDir, name))
+
+			if err != nil {
+				return nil, err
+			}
+
+			block, _ := pem.Decode(data)
+
+			if block == nil || block.Type != "CERTIFICATE" {
+				return nil, fmt.Errorf("%s is not a PEM certificate", name)
+			}
+
+			prints = append(prints, Fingerprint{Name: strings.TrimSuffix(name, certSuffix), SHA256: digest(block.Bytes)})
+		}
+	}
+
+	if len(prints) == 0 {
+		return nil, fmt.Errorf("no public keys for %s in %s", device, deviceDir)
+	}
+
+	return prints, nil
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Exists reports whether dir holds keys for device.
+func Exists(dir string, device string) bool {
+	if _, err := os.Stat(path.Join(dir, device+SealedSuffix)); err == nil {
+		return true
+	}
+
+	files, err := ioutil.ReadDir(path.Join(dir, device))
+
+	return err == nil && len(files) > 0
+}
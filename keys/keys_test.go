@@ -0,0 +1,24 @@
+package keys
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	dir := testDir(t, "crosshatch/releasekey.pk8", "crosshatch/platform.pk8", "sargo.tar.gpg",
+		"sargo/releasekey.x509.pem", "archive/sargo-1/sargo.tar.gpg", ".import-1/bonito/releasekey.pk8")
+
+	sets, err := List(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := fmt.Sprint(sets)
+	want := "[{crosshatch  false [platform.pk8 releasekey.pk8]} {sargo  true [releasekey.x509.pem]} {sargo sargo-1 true []}]"
+
+	if got != want {
+		t.Errorf("List returned %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Command runs a local shell command for every notification. The
+// notification is passed in LOCALSTACK_* environment variables.
+type Command struct {
+	Command string
+}
+
+func (c *Command) Notify(n *Notification) error {
+	cmd := exec.Command("sh", "-c", c.Command)
+	cmd.Env = append(os.Environ(),
+		"LOCALSTACK_STACK="+n.Stack,
+		"LOCALSTACK_DEVICE="+n.Device,
+		"LOCALSTACK_STATUS="+string(n.Status),
+		"LOCALSTACK_MESSAGE="+n.Message,
+		"LOCALSTACK_SUBJECT="+n.Subject(),
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		return fmt.Errorf("command %q failed: %v: %s", c.Command, err, out)
+	}
+
+	return nil
+}
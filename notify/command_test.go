@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localstack-notify")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	out := path.Join(dir, "notification")
+	c := &Command{
+		Command: `printf '%s\n' "$LOCALSTACK_STACK" "$LOCALSTACK_DEVICE" "$LOCALSTACK_STATUS" ` +
+			`"$LOCALSTACK_MESSAGE" "$LOCALSTACK_SUBJECT" > "$OUT"`,
+	}
+
+	os.Setenv("OUT", out)
+	defer os.Unsetenv("OUT")
+
+	for subject, n := range testNotifications() {
+		if err := c.Notify(n); err != nil {
+			t.Fatalf("Notify(%s) failed: %v", n.Status, err)
+		}
+
+		data, err := ioutil.ReadFile(out)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := strings.Join([]string{n.Stack, n.Device, string(n.Status), n.Message, subject}, "\n") + "\n"
+
+		if string(data) != want {
+			t.Errorf("command for %s got %q, want %q", n.Status, data, want)
+		}
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	c := &Command{Command: "echo no route to host; exit 3"}
+
+	for _, n := range testNotifications() {
+		err := c.Notify(n)
+
+		if err == nil {
+			t.Fatalf("Notify(%s) succeeded for a failing command", n.Status)
+		}
+
+		if !strings.Contains(err.Error(), "no route to host") {
+			t.Errorf("error %q doesn't have the output of the command", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Status is the state of a build as reported by the build script.
+type Status string
+
+const (
+	Started     Status = "STARTED"
+	Success     Status = "SUCCESS"
+	Failed      Status = "FAILED"
+	NotRequired Status = "NOT_REQUIRED"
+)
+
+// Notification is a single message about a build.
+type Notification struct {
+	Stack   string    `json:"stack"`
+	Device  string    `json:"device"`
+	Status  Status    `json:"status"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+func (n *Notification) Subject() string {
+	return fmt.Sprintf("localstack %s build %s", n.Device, strings.Replace(string(n.Status), "_", " ", -1))
+}
+
+// Notifier delivers notifications to one backend.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// Multi sends every notification to all of its backends.
+type Multi []Notifier
+
+func (m Multi) Notify(n *Notification) error {
+	errs := []string{}
+
+	for _, notifier := range m {
+		if err := notifier.Notify(n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send notification: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
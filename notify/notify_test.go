@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+// testNotifications returns a notification of every status the build script
+// sends, with the subject it is expected to have.
+func testNotifications() map[string]*Notification {
+	statuses := map[string]Status{
+		"localstack crosshatch build STARTED":      Started,
+		"localstack crosshatch build SUCCESS":      Success,
+		"localstack crosshatch build FAILED":       Failed,
+		"localstack crosshatch build NOT REQUIRED": NotRequired,
+	}
+
+	notifications := map[string]*Notification{}
+
+	for subject, status := range statuses {
+		notifications[subject] = &Notification{
+			Stack:   "localstack",
+			Device:  "crosshatch",
+			Status:  status,
+			Message: "RattlesnakeOS Build " + string(status),
+			Time:    time.Unix(1600000000, 0),
+		}
+	}
+
+	return notifications
+}
+
+func TestSubject(t *testing.T) {
+	for subject, n := range testNotifications() {
+		if got := n.Subject(); got != subject {
+			t.Errorf("Subject() of %s = %q, want %q", n.Status, got, subject)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Addresses splits a comma separated list of email addresses, as written in
+// the config file, dropping the spaces around each address and empty ones.
+func Addresses(list string) []string {
+	addresses := []string{}
+
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addresses = append(addresses, a)
+		}
+	}
+
+	return addresses
+}
+
+// SMTP sends notifications by email. Authentication is skipped when
+// Username is empty, e.g. for a relay on localhost.
+type SMTP struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTP) message(n *Notification) []byte {
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "From: %s\r\n", s.From)
+	for _, to := range s.To {
+		fmt.Fprintf(buf, "To: %s\r\n", to)
+	}
+	fmt.Fprintf(buf, "Subject: %s\r\n", n.Subject())
+	fmt.Fprintf(buf, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "\r\n%s\r\n", n.Message)
+
+	return buf.Bytes()
+}
+
+func (s *SMTP) Notify(n *Notification) error {
+	var auth smtp.Auth
+
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+
+		if err != nil {
+			return fmt.Errorf("invalid smtp server %s: %v", s.Addr, err)
+		}
+
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, s.To, s.message(n)); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package notify
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMail is a message received by fakeSMTP.
+type smtpMail struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP accepts mail on a local port, one session per connection, and
+// hands every message to mails.
+type fakeSMTP struct {
+	listener net.Listener
+	mails    chan *smtpMail
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTP{
+		listener: listener,
+		mails:    make(chan *smtpMail, 1),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTP) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeSMTP) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeSMTP) serve(c net.Conn) {
+	conn := textproto.NewConn(c)
+	defer conn.Close()
+
+	mail := &smtpMail{}
+	conn.PrintfLine("220 localhost ESMTP")
+
+	for {
+		line, err := conn.ReadLine()
+
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			conn.PrintfLine("250-localhost")
+			conn.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				conn.PrintfLine("501 malformed AUTH")
+				continue
+			}
+			auth, _ := base64.StdEncoding.DecodeString(fields[2])
+			mail.auth = string(auth)
+			conn.PrintfLine("235 authenticated")
+		case "MAIL":
+			mail.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			mail.to = append(mail.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 go ahead")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data)
+			conn.PrintfLine("250 queued")
+			s.mails <- mail
+			mail = &smtpMail{}
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	server := newFakeSMTP(t)
+	defer server.Close()
+
+	s := &SMTP{
+		Addr: server.Addr(),
+		From: "localstack@example.com",
+		To:   []string{"alice@example.com", "bob@example.com"},
+	}
+
+	for subject, n := range testNotifications() {
+		if err := s.Notify(n); err != nil {
+			t.Fatalf("Notify(%s) failed: %v", n.Status, err)
+		}
+
+		mail := <-server.mails
+
+		if mail.auth != "" {
+			t.Errorf("authenticated without a username")
+		}
+
+		if mail.from != s.From {
+			t.Errorf("MAIL FROM %s, want %s", mail.from, s.From)
+		}
+
+		if strings.Join(mail.to, ",") != strings.Join(s.To, ",") {
+			t.Errorf("RCPT TO %v, want %v", mail.to, s.To)
+		}
+
+		for _, header := range []string{
+			"From: localstack@example.com\n",
+			"To: alice@example.com\n",
+			"To: bob@example.com\n",
+			"Subject: " + subject + "\n",
+			"Date: " + n.Time.Format(time.RFC1123Z) + "\n",
+		} {
+			if !strings.Contains(mail.data, header) {
+				t.Errorf("mail for %s is missing %q:\n%s", n.Status, header, mail.data)
+			}
+		}
+
+		if !strings.HasSuffix(mail.data, "\n"+n.Message+"\n") {
+			t.Errorf("mail for %s doesn't end in the message:\n%s", n.Status, mail.data)
+		}
+	}
+}
+
+func TestSMTPAuth(t *testing.T) {
+	server := newFakeSMTP(t)
+	defer server.Close()
+
+	s := &SMTP{
+		Addr:     server.Addr(),
+		From:     "localstack@example.com",
+		To:       []string{"alice@example.com"},
+		Username: "localstack",
+		Password: "secret",
+	}
+
+	for _, n := range testNotifications() {
+		if err := s.Notify(n); err != nil {
+			t.Fatalf("Notify(%s) failed: %v", n.Status, err)
+		}
+
+		mail := <-server.mails
+
+		if mail.auth != "\x00localstack\x00secret" {
+			t.Errorf("AUTH PLAIN %q, want user localstack and password secret", mail.auth)
+		}
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	tests := map[string]string{
+		"alice@example.com":                      "alice@example.com",
+		"alice@example.com,bob@example.com":      "alice@example.com|bob@example.com",
+		"alice@example.com, bob@example.com":     "alice@example.com|bob@example.com",
+		" alice@example.com ,, bob@example.com,": "alice@example.com|bob@example.com",
+		" , ":                                    "",
+	}
+
+	for list, want := range tests {
+		if got := strings.Join(Addresses(list), "|"); got != want {
+			t.Errorf("Addresses(%q) = %q, want %q", list, got, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook POSTs every notification as JSON to URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *Webhook) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+
+	if err != nil {
+		return err
+	}
+
+	client := w.Client
+
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("webhook: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: %s returned %s", w.URL, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan *Notification, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %s, want application/json", ct)
+		}
+
+		n := &Notification{}
+
+		if err := json.NewDecoder(r.Body).Decode(n); err != nil {
+			t.Errorf("malformed payload: %v", err)
+		}
+
+		received <- n
+	}))
+
+	defer server.Close()
+
+	w := &Webhook{URL: server.URL}
+
+	for _, n := range testNotifications() {
+		if err := w.Notify(n); err != nil {
+			t.Fatalf("Notify(%s) failed: %v", n.Status, err)
+		}
+
+		got := <-received
+
+		if got.Stack != n.Stack || got.Device != n.Device || got.Status != n.Status || got.Message != n.Message ||
+			!got.Time.Equal(n.Time) {
+			t.Errorf("webhook received %+v, want %+v", got, n)
+		}
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+
+	defer server.Close()
+
+	w := &Webhook{URL: server.URL}
+
+	for _, n := range testNotifications() {
+		if err := w.Notify(n); err == nil {
+			t.Errorf("Notify(%s) succeeded on %d", n.Status, http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package ota
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Channels lists the release channels the Updater app knows about, in the
+// order builds are promoted through them.
+var Channels = []string{"dev", "beta", "stable"}
+
+// Variants lists the build variants. Builds of every variant but user are
+// published to a subdirectory of the release directory named after it.
+var Variants = []string{"user", "userdebug", "eng"}
+
+var (
+	otaPattern         = regexp.MustCompile(`^[a-z0-9]+-ota_update-[0-9.]+\.zip$`)
+	incrementalPattern = regexp.MustCompile(`^[a-z0-9]+-incremental-[0-9.]+-[0-9.]+\.zip$`)
+	channelPattern     = regexp.MustCompile(`^[a-z0-9]+-([a-z]+)$`)
+	timestampSuffix    = "-true-timestamp"
+)
+
+// Server serves the contents of the release mount over http(s). Only the files
+// the Updater app requests are exposed; target files, chromium apks and the
+// version checkpoints written by the build script are never served.
+type Server struct {
+	root     string
+	listen   string
+	certFile string
+	keyFile  string
+}
+
+func NewServer(root string, listen string, certFile string, keyFile string) (*Server, error) {
+	info, err := os.Stat(root)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat release directory: %v", err)
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("release path %s is not a directory", root)
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both a tls certificate and key are required to serve https")
+	}
+
+	return &Server{
+		root:     root,
+		listen:   listen,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}, nil
+}
+
+// ValidChannel reports whether channel is one of Channels.
+func ValidChannel(channel string) bool {
+	for _, c := range Channels {
+		if channel == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextChannel returns the channel builds of channel are promoted to, or "" for
+// the last one.
+func NextChannel(channel string) string {
+	for i, c := range Channels[:len(Channels)-1] {
+		if channel == c {
+			return Channels[i+1]
+		}
+	}
+
+	return ""
+}
+
+// ValidVariant reports whether variant is one of Variants.
+func ValidVariant(variant string) bool {
+	for _, v := range Variants {
+		if variant == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VariantDir returns the directory of the release directory builds of
+// variant are published to, "" for user builds.
+func VariantDir(variant string) string {
+	if variant == "" || variant == "user" {
+		return ""
+	}
+	return variant
+}
+
+func isChannel(name string) bool {
+	m := channelPattern.FindStringSubmatch(name)
+
+	if m == nil {
+		return false
+	}
+
+	return ValidChannel(m[1])
+}
+
+// Allowed reports whether a file in the release directory may be served.
+// Files of debug variants are only served from their own directory.
+func Allowed(name string) bool {
+	if dir, file := path.Split(name); dir != "" {
+		dir = strings.TrimSuffix(dir, "/")
+
+		if !ValidVariant(dir) || VariantDir(dir) == "" {
+			return false
+		}
+
+		name = file
+	}
+
+	if otaPattern.MatchString(name) || incrementalPattern.MatchString(name) {
+		return true
+	}
+
+	if strings.HasSuffix(name, timestampSuffix) {
+		return isChannel(strings.TrimSuffix(name, timestampSuffix))
+	}
+
+	return isChannel(name)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+	if !Allowed(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := path.Join(s.root, name)
+	info, err := os.Stat(file)
+
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasSuffix(name, ".zip") {
+		// metadata changes in place on every release
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	log.Infof("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+	http.ServeFile(w, r, file)
+}
+
+// ListenAndServe blocks serving the release directory until the listener fails.
+func (s *Server) ListenAndServe() error {
+	srv := &http.Server{
+		Addr:    s.listen,
+		Handler: s,
+	}
+
+	if s.certFile != "" {
+		log.Infof("serving %s on https://%s", s.root, s.listen)
+		return srv.ListenAndServeTLS(s.certFile, s.keyFile)
+	}
+
+	log.Infof("serving %s on http://%s", s.root, s.listen)
+	return srv.ListenAndServe()
+}
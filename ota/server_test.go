@@ -0,0 +1,136 @@
+package ota
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{"crosshatch-ota_update-2020.10.17.03.zip", true},
+		{"crosshatch-incremental-2020.10.10.03-2020.10.17.03.zip", true},
+		{"crosshatch-dev", true},
+		{"crosshatch-beta", true},
+		{"crosshatch-stable", true},
+		{"crosshatch-stable-true-timestamp", true},
+		{"userdebug/crosshatch-ota_update-2020.10.17.03.zip", true},
+		{"userdebug/crosshatch-incremental-2020.10.10.03-2020.10.17.03.zip", true},
+		{"userdebug/crosshatch-dev", true},
+		{"eng/crosshatch-dev-true-timestamp", true},
+
+		{"user/crosshatch-ota_update-2020.10.17.03.zip", false},
+		{"user/crosshatch-dev", false},
+		{"crosshatch-nightly", false},
+		{"crosshatch-nightly-true-timestamp", false},
+		{"userdebug/crosshatch-nightly", false},
+		{"../crosshatch-dev", false},
+		{"../crosshatch-ota_update-2020.10.17.03.zip", false},
+		{"userdebug/../crosshatch-dev", false},
+		{"crosshatch-target_files-2020.10.17.03.zip", false},
+		{"crosshatch-target/crosshatch-target-files-2020.10.17.03.zip", false},
+		{"crosshatch-dev-target/crosshatch-target-files-2020.10.17.03.zip", false},
+		{"crosshatch-factory-2020.10.17.03.tar.xz", false},
+		{"crosshatch-factory-latest.tar.xz", false},
+		{"userdebug/crosshatch-factory-latest.tar.xz", false},
+		{"crosshatch-vendor", false},
+		{"chromium/revision", false},
+		{"index/crosshatch-2020.10.17.03.json", false},
+		{"profiles/pixel3a/crosshatch-dev", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := Allowed(test.name); got != test.allowed {
+			t.Errorf("Allowed(%q) = %v, want %v", test.name, got, test.allowed)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	root, err := ioutil.TempDir("", "localstack-release")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	for _, name := range []string{
+		"crosshatch-dev",
+		"crosshatch-ota_update-2020.10.17.03.zip",
+		"crosshatch-factory-latest.tar.xz",
+		"userdebug/crosshatch-dev",
+	} {
+		if err := os.MkdirAll(path.Join(root, path.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// directories named like files the Updater app requests
+	for _, name := range []string{"crosshatch-beta", "userdebug/crosshatch-ota_update-2020.10.17.03.zip"} {
+		if err := os.MkdirAll(path.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewServer(root, "127.0.0.1:0", "", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		cache  string
+	}{
+		{http.MethodGet, "/crosshatch-dev", http.StatusOK, "no-cache"},
+		{http.MethodHead, "/crosshatch-dev", http.StatusOK, "no-cache"},
+		{http.MethodGet, "/crosshatch-ota_update-2020.10.17.03.zip", http.StatusOK, ""},
+		{http.MethodGet, "/userdebug/crosshatch-dev", http.StatusOK, "no-cache"},
+		// http.ServeFile refuses .. in the request path
+		{http.MethodGet, "/userdebug/../crosshatch-dev", http.StatusBadRequest, ""},
+		{http.MethodGet, "/../crosshatch-factory-latest.tar.xz", http.StatusNotFound, ""},
+		{http.MethodGet, "/crosshatch-stable", http.StatusNotFound, ""},
+		{http.MethodGet, "/crosshatch-factory-latest.tar.xz", http.StatusNotFound, ""},
+		{http.MethodGet, "/crosshatch-beta", http.StatusNotFound, ""},
+		{http.MethodGet, "/userdebug/crosshatch-ota_update-2020.10.17.03.zip", http.StatusNotFound, ""},
+		{http.MethodGet, "/userdebug/", http.StatusNotFound, ""},
+		{http.MethodGet, "/", http.StatusNotFound, ""},
+		{http.MethodPost, "/crosshatch-dev", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s %s returned %d, want %d", test.method, test.path, w.Code, test.status)
+			continue
+		}
+
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		if got := w.Header().Get("Cache-Control"); got != test.cache {
+			t.Errorf("%s %s has Cache-Control %q, want %q", test.method, test.path, got, test.cache)
+		}
+
+		if test.method == http.MethodGet && w.Body.String() != path.Clean(test.path)[1:] {
+			t.Errorf("GET %s returned %q", test.path, w.Body.String())
+		}
+	}
+}
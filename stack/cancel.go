@@ -0,0 +1,151 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// buildPgidFile holds the process group of the build running in a
+	// container, there is at most one per container
+	buildPgidFile = "/tmp/localstack-build.pgid"
+	// launchScript starts the build script as the leader of its own process
+	// group, which is signalled as a whole to cancel the build
+	launchScript = `echo $$ > "${LOCALSTACK_PGID}"; exec bash "$@"`
+)
+
+// ErrCancelled is returned by a build stopped through its context.
+var ErrCancelled = errors.New("build cancelled")
+
+type execResult struct {
+	code int
+	err  error
+}
+
+// signalBuild sends SIGTERM to every process of the build, the build script
+// cleans up and reports the failed step before it exits.
+func (s *DockerStack) signalBuild() error {
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    []string{"bash", "-c", fmt.Sprintf(`kill -TERM -- -$(cat %s)`, buildPgidFile)},
+		User:   "root",
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("kill exited with %d", code)
+	}
+
+	return nil
+}
+
+// stopBuild signals the build and waits stopTimeout for it to exit before
+// stopping the container.
+func (s *DockerStack) stopBuild(exited func() bool) {
+	log.Warnf("stopping build of %s", s.Name())
+
+	if err := s.signalBuild(); err != nil {
+		log.Warnf("failed to signal build: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Duration(s.stopTimeout) * time.Second)
+
+	for time.Now().Before(deadline) {
+		if exited() {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+
+	log.Warnf("build of %s did not exit after %d seconds", s.Name(), s.stopTimeout)
+
+	if err := s.stopContainer(); err != nil {
+		log.Warnf("failed to stop container: %v", err)
+	}
+}
+
+// runExec runs an exec in the build container until it exits, or stops it
+// once ctx is cancelled.
+func (s *DockerStack) runExec(ctx context.Context, spec *ExecSpec) (int, error) {
+	done := make(chan execResult, 1)
+
+	go func() {
+		code, err := s.runtime.Exec(s.containerName(), spec)
+		done <- execResult{code, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.code, res.err
+	case <-ctx.Done():
+	}
+
+	var res execResult
+	exited := false
+
+	s.stopBuild(func() bool {
+		select {
+		case res = <-done:
+			exited = true
+		default:
+		}
+		return exited
+	})
+
+	if !exited {
+		// stopping the container ends the exec
+		res = <-done
+	}
+
+	return res.code, ErrCancelled
+}
+
+// Cancel stops the detached build of this stack.
+func (s *DockerStack) Cancel() error {
+	b, err := FindDetachedBuild(s.config.StatePath, s.Name())
+
+	if err != nil {
+		return err
+	}
+
+	status, err := b.Status(s.config.StatePath)
+
+	if err != nil {
+		return err
+	}
+
+	if !status.Running {
+		return fmt.Errorf("build %s of %s is not running", b.ID, s.Name())
+	}
+
+	if !s.containerExists() {
+		log.Warnf("build container of %s is gone, marking build %s as cancelled", s.Name(), b.ID)
+		return writeExitCode(s.config.StatePath, b, 143)
+	}
+
+	s.stopBuild(func() bool {
+		status, err := b.Status(s.config.StatePath)
+		return err == nil && !status.Running
+	})
+
+	if status, err := b.Status(s.config.StatePath); err == nil && status.Running {
+		// the container was stopped before the build could record its exit
+		return writeExitCode(s.config.StatePath, b, 143)
+	}
+
+	return nil
+}
+
+func writeExitCode(statePath string, b *DetachedBuild, code int) error {
+	return ioutil.WriteFile(b.exitPath(statePath), []byte(fmt.Sprintf("%d\n", code)), 0644)
+}
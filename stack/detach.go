@@ -0,0 +1,301 @@
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	detachedDir = "detached"
+	exitSuffix  = ".exit"
+	// detachScript runs the build in its own session so it outlives the
+	// exec that started it, and records the exit code next to the log. The
+	// wrapper leads the process group of the build, it must survive the
+	// signal cancelling the build to record its exit
+	detachScript = `setsid bash -c 'echo $$ > "${LOCALSTACK_PGID}"; trap : TERM INT; bash "$@" > "${LOCALSTACK_LOG}" 2>&1 < /dev/null; echo $? > "${LOCALSTACK_EXIT}"' build "$@" > /dev/null 2>&1 < /dev/null &`
+)
+
+// DetachedBuild is a build started with BuildOptions.Detach. It keeps running
+// in the build container after localstack exits.
+type DetachedBuild struct {
+	ID      string    `json:"id"`
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+}
+
+// BuildStatus is the progress of a detached build.
+type BuildStatus struct {
+	Running bool
+	// Step is the step running, or the last one started if the build is
+	// not running anymore
+	Step     string
+	ExitCode int
+	Finished time.Time
+}
+
+// Elapsed returns how long the build has been running, or how long it took.
+func (b *DetachedBuild) Elapsed(status *BuildStatus) time.Duration {
+	if status.Running {
+		return time.Since(b.Started)
+	}
+	return status.Finished.Sub(b.Started)
+}
+
+func detachedBuildPath(statePath string, target string) string {
+	return path.Join(StateDir(statePath), detachedDir, target+".json")
+}
+
+func writeDetachedBuild(statePath string, b *DetachedBuild) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	p := detachedBuildPath(statePath, b.Target)
+
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, data, 0600)
+}
+
+// DetachedBuilds returns the last detached build of every target, oldest
+// first.
+func DetachedBuilds(statePath string) ([]DetachedBuild, error) {
+	dir := path.Join(StateDir(statePath), detachedDir)
+	files, err := ioutil.ReadDir(dir)
+
+	if os.IsNotExist(err) {
+		return []DetachedBuild{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read detached builds: %v", err)
+	}
+
+	builds := []DetachedBuild{}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		b := DetachedBuild{}
+
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", f.Name(), err)
+		}
+
+		builds = append(builds, b)
+	}
+
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Started.Before(builds[j].Started)
+	})
+
+	return builds, nil
+}
+
+// FindDetachedBuild returns the last detached build of target, or the most
+// recent detached build if target is empty.
+func FindDetachedBuild(statePath string, target string) (*DetachedBuild, error) {
+	builds, err := DetachedBuilds(statePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(builds) - 1; i >= 0; i-- {
+		if target == "" || builds[i].Target == target {
+			return &builds[i], nil
+		}
+	}
+
+	if target == "" {
+		return nil, fmt.Errorf("no detached builds found")
+	}
+
+	return nil, fmt.Errorf("no detached build of %s found", target)
+}
+
+// LogPath returns the build log of b.
+func (b *DetachedBuild) LogPath(statePath string) string {
+	return path.Join(LogsPath(statePath), b.ID+logSuffix)
+}
+
+func (b *DetachedBuild) exitPath(statePath string) string {
+	return path.Join(LogsPath(statePath), b.ID+exitSuffix)
+}
+
+// Status reads the progress of b from its events and exit code.
+func (b *DetachedBuild) Status(statePath string) (*BuildStatus, error) {
+	status := &BuildStatus{Running: true}
+
+	events, err := ioutil.ReadFile(path.Join(LogsPath(statePath), b.ID+eventsSuffix))
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read build events: %v", err)
+	}
+
+	for _, line := range strings.Split(string(events), "\n") {
+		event, err := parseStepEvent(line)
+
+		if err == nil && event.Kind == StepStarted {
+			status.Step = event.Step
+		}
+	}
+
+	exitFile := b.exitPath(statePath)
+	info, err := os.Stat(exitFile)
+
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(exitFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+	if err != nil {
+		// the exit file is written in one go, it may not be complete yet
+		return status, nil
+	}
+
+	status.Running = false
+	status.ExitCode = code
+	status.Finished = info.ModTime()
+
+	return status, nil
+}
+
+// Attach copies the log of b to w as it is written, until the build exits or
+// ctx is cancelled. It returns the last status of the build.
+func (b *DetachedBuild) Attach(ctx context.Context, statePath string, w io.Writer) (*BuildStatus, error) {
+	f, err := os.Open(b.LogPath(statePath))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %v", err)
+	}
+
+	defer f.Close()
+
+	for {
+		// check before copying so nothing written before the exit is missed
+		status, err := b.Status(statePath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.Copy(w, f); err != nil {
+			return nil, fmt.Errorf("failed to read log: %v", err)
+		}
+
+		if !status.Running {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, nil
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// detachedBuildRunning reports whether a detached build of target is still
+// running.
+func detachedBuildRunning(statePath string, target string) bool {
+	b, err := FindDetachedBuild(statePath, target)
+
+	if err != nil {
+		return false
+	}
+
+	status, err := b.Status(statePath)
+
+	return err == nil && status.Running
+}
+
+func detachedBuildsRunning(statePath string) bool {
+	builds, err := DetachedBuilds(statePath)
+
+	if err != nil {
+		return false
+	}
+
+	for _, b := range builds {
+		if detachedBuildRunning(statePath, b.Target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// execDetached starts the build script in the background. args are the
+// arguments of a foreground build, starting with the interpreter.
+func (s *DockerStack) execDetached(buildID string, args []string, env []string) error {
+	env = append(env,
+		"LOCALSTACK_EVENTS=/logs/"+buildID+eventsSuffix,
+		"LOCALSTACK_LOG=/logs/"+buildID+logSuffix,
+		"LOCALSTACK_EXIT=/logs/"+buildID+exitSuffix,
+		"LOCALSTACK_PGID="+buildPgidFile,
+	)
+
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    append([]string{"bash", "-c", detachScript, "detach"}, args[1:]...),
+		Env:    env,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("failed to start detached build, exited with %d", code)
+	}
+
+	err = writeDetachedBuild(s.config.StatePath, &DetachedBuild{
+		ID:      buildID,
+		Target:  s.Name(),
+		Started: time.Now(),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record detached build: %v", err)
+	}
+
+	log.Infof("build %s of %s is running in the background, follow it with 'localstack attach %s'", buildID, s.Name(), s.Name())
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+// dockerRuntime talks to a Docker Engine found through DOCKER_HOST and the
+// other standard docker environment variables.
+type dockerRuntime struct {
+	ctx context.Context
+	cli *client.Client
+}
+
+func newDockerRuntime() (*dockerRuntime, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create docker api client: %v", err)
+	}
+
+	ctx := context.Background()
+
+	if _, err := cli.Ping(ctx); err != nil {
+		cli.Close()
+		return nil, fmt.Errorf("failed to connect to docker at %s: %v", cli.DaemonHost(), err)
+	}
+
+	return &dockerRuntime{
+		ctx: ctx,
+		cli: cli,
+	}, nil
+}
+
+func (r *dockerRuntime) BuildImage(ctx context.Context, contextDir string, tag string) error {
+	buildContext, err := archive.TarWithOptions(contextDir, &archive.TarOptions{})
+
+	if err != nil {
+		return fmt.Errorf("failed to archive build context %s: %v", contextDir, err)
+	}
+
+	defer buildContext.Close()
+
+	resp, err := r.cli.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:       []string{tag},
+		Dockerfile: "Dockerfile",
+		PullParent: true,
+		Remove:     true,
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to build image %s: %v", tag, err)
+	}
+
+	defer resp.Body.Close()
+
+	fd, isTerminal := termFd(os.Stdout)
+
+	err = jsonmessage.DisplayJSONMessagesStream(resp.Body, os.Stdout, fd, isTerminal, nil)
+
+	if err != nil {
+		return fmt.Errorf("failed to build image %s: %v", tag, err)
+	}
+
+	return nil
+}
+
+func termFd(f *os.File) (uintptr, bool) {
+	info, err := f.Stat()
+
+	return f.Fd(), err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *dockerRuntime) EnsureVolume(name string) error {
+	if _, err := r.cli.VolumeInspect(r.ctx, name); err == nil {
+		return nil
+	}
+
+	_, err := r.cli.VolumeCreate(r.ctx, volume.VolumeCreateBody{
+		Name: name,
+	})
+
+	if err != nil {
+		return fmt.Errorf("Error, failed to create volume %v", err)
+	}
+
+	return nil
+}
+
+// replaceVolumeScript runs in the helper container of WithVolume, files fn
+// removed have to disappear from the volume too
+const replaceVolumeScript = "find /volume -mindepth 1 -delete && cp -a /staging/. /volume/"
+
+// WithVolume copies the volume to a temporary directory through a helper
+// container, docker keeps volumes in a directory only root can read. The
+// helper is created from the build image, which exists once the stack is
+// deployed. With write the copy is staged in the helper and the helper is
+// started to replace the content of the volume with it. The copy is removed
+// once fn returns.
+func (r *dockerRuntime) WithVolume(name string, write bool, fn func(dir string) error) error {
+	tmp, err := ioutil.TempDir("", "localstack-volume")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	config := &container.Config{
+		Image: imageTag,
+		User:  "root",
+		Cmd:   []string{"sh", "-c", replaceVolumeScript},
+	}
+
+	resp, err := r.cli.ContainerCreate(r.ctx, config, &container.HostConfig{
+		Mounts: []mount.Mount{
+			{Type: mount.TypeVolume, Source: name, Target: "/volume"},
+		},
+	}, nil, nil, "")
+
+	if err != nil {
+		return fmt.Errorf("failed to create helper container for volume %s: %v", name, err)
+	}
+
+	defer r.cli.ContainerRemove(r.ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+
+	content, _, err := r.cli.CopyFromContainer(r.ctx, resp.ID, "/volume")
+
+	if err != nil {
+		return fmt.Errorf("failed to copy volume %s: %v", name, err)
+	}
+
+	err = archive.Untar(content, tmp, &archive.TarOptions{NoLchown: true})
+	content.Close()
+
+	if err != nil {
+		return fmt.Errorf("failed to copy volume %s: %v", name, err)
+	}
+
+	dir := path.Join(tmp, "volume")
+
+	if err := fn(dir); err != nil {
+		return err
+	}
+
+	if !write {
+		return nil
+	}
+
+	// the whole copy has to reach the helper before the volume is emptied
+	content, err = archive.TarWithOptions(tmp, &archive.TarOptions{
+		IncludeFiles: []string{"volume"},
+		RebaseNames:  map[string]string{"volume": "staging"},
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to archive volume %s: %v", name, err)
+	}
+
+	defer content.Close()
+
+	err = r.cli.CopyToContainer(r.ctx, resp.ID, "/", content, types.CopyToContainerOptions{})
+
+	if err != nil {
+		return fmt.Errorf("failed to copy back volume %s: %v", name, err)
+	}
+
+	if err := r.cli.ContainerStart(r.ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start helper container for volume %s: %v", name, err)
+	}
+
+	statusCh, errCh := r.cli.ContainerWait(r.ctx, resp.ID, container.WaitConditionNotRunning)
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("failed to copy back volume %s: %v", name, err)
+	case status := <-statusCh:
+		if status.StatusCode != 0 {
+			return fmt.Errorf("failed to copy back volume %s: helper exited with %d", name, status.StatusCode)
+		}
+	}
+
+	return nil
+}
+
+func (r *dockerRuntime) ContainerExists(name string) bool {
+	_, err := r.cli.ContainerInspect(r.ctx, name)
+
+	return err == nil
+}
+
+func (r *dockerRuntime) RunContainer(c *ContainerSpec) error {
+	config := &container.Config{
+		Image:        c.Image,
+		Tty:          c.Terminal,
+		OpenStdin:    c.Terminal,
+		ExposedPorts: nat.PortSet{},
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{},
+	}
+
+	if c.Resources.CPUs > 0 {
+		hostConfig.NanoCPUs = int64(c.Resources.CPUs) * 1e9
+	}
+
+	if c.Resources.Memory > 0 {
+		hostConfig.Memory = c.Resources.Memory
+		// like the OCI limit, MemorySwap is memory and swap combined
+		hostConfig.MemorySwap = c.Resources.Memory + c.Resources.Swap
+	}
+
+	if c.Resources.Pids > 0 {
+		pids := c.Resources.Pids
+		hostConfig.PidsLimit = &pids
+	}
+
+	for k, v := range c.Env {
+		config.Env = append(config.Env, k+"="+v)
+	}
+
+	for _, m := range c.Mounts {
+		mnt := mount.Mount{
+			Source:   m.Source,
+			Target:   m.Destination,
+			ReadOnly: m.ReadOnly,
+		}
+
+		switch m.Type {
+		case MountVolume:
+			mnt.Type = mount.TypeVolume
+		case MountTmpfs:
+			mnt.Type = mount.TypeTmpfs
+			mnt.TmpfsOptions = &mount.TmpfsOptions{
+				SizeBytes: m.TmpfsSize,
+				Mode:      m.TmpfsMode,
+			}
+		default:
+			mnt.Type = mount.TypeBind
+		}
+
+		hostConfig.Mounts = append(hostConfig.Mounts, mnt)
+	}
+
+	for _, p := range c.Ports {
+		port, err := nat.NewPort("tcp", strconv.Itoa(int(p.ContainerPort)))
+
+		if err != nil {
+			return err
+		}
+
+		config.ExposedPorts[port] = struct{}{}
+		hostConfig.PortBindings[port] = []nat.PortBinding{
+			{HostPort: strconv.Itoa(int(p.HostPort))},
+		}
+	}
+
+	resp, err := r.cli.ContainerCreate(r.ctx, config, hostConfig, nil, nil, c.Name)
+
+	if err != nil {
+		return fmt.Errorf("error creating container: %v", err)
+	}
+
+	err = r.cli.ContainerStart(r.ctx, resp.ID, types.ContainerStartOptions{})
+
+	if err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+
+	return nil
+}
+
+func (r *dockerRuntime) StopContainer(name string, timeout uint) error {
+	t := time.Duration(timeout) * time.Second
+
+	return r.cli.ContainerStop(r.ctx, name, &t)
+}
+
+func (r *dockerRuntime) RemoveContainer(name string, force bool) error {
+	return r.cli.ContainerRemove(r.ctx, name, types.ContainerRemoveOptions{
+		Force: force,
+	})
+}
+
+func (r *dockerRuntime) Exec(container string, e *ExecSpec) (int, error) {
+	exec, err := r.cli.ContainerExecCreate(r.ctx, container, types.ExecConfig{
+		AttachStderr: true,
+		AttachStdout: true,
+		AttachStdin:  e.Stdin != nil,
+		User:         e.User,
+		Env:          e.Env,
+		Cmd:          e.Cmd,
+	})
+
+	if err != nil {
+		return -1, fmt.Errorf("ExecCreate failed: %v", err)
+	}
+
+	resp, err := r.cli.ContainerExecAttach(r.ctx, exec.ID, types.ExecStartCheck{})
+
+	if err != nil {
+		return -1, fmt.Errorf("Failed to attach to container: %v", err)
+	}
+
+	defer resp.Close()
+
+	if e.Stdin != nil {
+		go func() {
+			io.Copy(resp.Conn, e.Stdin)
+			resp.CloseWrite()
+		}()
+	}
+
+	_, err = stdcopy.StdCopy(e.Stdout, e.Stderr, resp.Reader)
+
+	if err != nil {
+		return -1, fmt.Errorf("failed to read build output: %v", err)
+	}
+
+	session, err := r.cli.ContainerExecInspect(r.ctx, exec.ID)
+
+	if err != nil {
+		return -1, fmt.Errorf("failed to inspect exec session: %v", err)
+	}
+
+	return session.ExitCode, nil
+}
+
+func (r *dockerRuntime) Close() error {
+	return r.cli.Close()
+}
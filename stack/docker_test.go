@@ -0,0 +1,119 @@
+package stack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.io/gnu3ra/localstack/keys"
+)
+
+// dockerTestRuntime connects to the Docker Engine of the environment when
+// LOCALSTACK_TEST_DOCKER is set. The engine needs the build image, the
+// helper container of WithVolume is created from it.
+func dockerTestRuntime(t *testing.T) *dockerRuntime {
+	if os.Getenv("LOCALSTACK_TEST_DOCKER") == "" {
+		t.Skip("LOCALSTACK_TEST_DOCKER is not set")
+	}
+
+	r, err := newDockerRuntime()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+func writeTestFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		if err := os.MkdirAll(path.Join(dir, path.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func volumeFiles(t *testing.T, r *dockerRuntime, name string) []string {
+	files := []string{}
+
+	err := r.WithVolume(name, false, func(dir string) error {
+		return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, strings.TrimPrefix(p, dir+"/"))
+			}
+			return err
+		})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+func TestWithVolumeImportReplacesKeys(t *testing.T) {
+	r := dockerTestRuntime(t)
+	name := "localstack-test-keys"
+
+	if err := r.EnsureVolume(name); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { r.cli.VolumeRemove(r.ctx, name, true) })
+
+	// a sealed set with a stale plaintext key next to it
+	err := r.WithVolume(name, true, func(dir string) error {
+		writeTestFiles(t, dir, "crosshatch/old.pk8", "crosshatch.tar.gpg")
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := ioutil.TempDir("", "localstack-keys")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(src)
+
+	writeTestFiles(t, src, "crosshatch/releasekey.pk8", "crosshatch/releasekey.x509.pem")
+
+	archive := &bytes.Buffer{}
+
+	if err := keys.Export(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.WithVolume(name, true, func(dir string) error {
+		_, err := keys.Import(dir, archive, true)
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(volumeFiles(t, r, name), ",")
+	want := "crosshatch/releasekey.pk8,crosshatch/releasekey.x509.pem"
+
+	if got != want {
+		t.Errorf("volume holds %s after the import, want %s", got, want)
+	}
+}
@@ -1,43 +1,38 @@
 package stack
 
 import (
-	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
-	"time"
-
-	"github.com/containers/buildah"
-	"github.com/containers/buildah/imagebuildah"
-	"github.com/containers/podman/v2/libpod/define"
-	"github.com/containers/podman/v2/pkg/api/handlers"
-	"github.com/containers/podman/v2/pkg/bindings"
-	"github.com/containers/podman/v2/pkg/bindings/containers"
-	"github.com/containers/podman/v2/pkg/bindings/images"
-	"github.com/containers/podman/v2/pkg/bindings/volumes"
-	"github.com/containers/podman/v2/pkg/domain/entities"
-	"github.com/containers/podman/v2/pkg/specgen"
-	"github.com/containers/storage/pkg/archive"
-	"github.com/opencontainers/runtime-spec/specs-go"
-
-	"github.com/docker/docker/api/types"
+	"strings"
+
 	"github.com/jhoonb/archivex"
 	log "github.com/sirupsen/logrus"
 	"github.io/gnu3ra/localstack/buildtemplates"
+	"github.io/gnu3ra/localstack/devices"
+	"github.io/gnu3ra/localstack/ota"
 	"github.io/gnu3ra/localstack/utils"
 )
 
 const (
 	imageTag = "localstack-build-image"
-	sockPath = "/tmp/localstack.sock"
 	containerName = "localstack-build"
 	buildVolumeName = "localstack-build"
 	keysVolumeName = "localstack-keys"
+	// keysTmpfsPath is KEYS_DIR of the build script
+	keysTmpfsPath = "/build/build/keys"
+	// secretsTmpfsPath is SECRETS_DIR of the build script
+	secretsTmpfsPath = "/run/localstack"
 	scriptsVolumeName = "localstack-scripts"
 	releaseVolumeName = "localstack-release"
+	attestationImageTag = "localstack-attestation-image"
+	attestationContainerName = "localstack-attestation"
+	attestationVolumeName = "localstack-attestation"
+	attestationContainerPort = 8080
 	containerStopTimeout = 30
 )
 
@@ -56,71 +51,73 @@ type DockerStackConfig struct {
 	CustomManifestProjects *utils.CustomManifestProjects
 	HostsFile              string
 	EnableAttestation      bool
+	// AttestationCommit is the AttestationServer commit the attestation
+	// server is built from
+	AttestationCommit      string
+	EncryptedKeys          bool
+	Keys                   KeysConfig
+	AttestationPort        int
 	StatePath              string
+	ReleaseURL             string
+	// Variant is the build variant of the default profile, see ota.Variants
+	Variant                string
 	NumProc                int
+	// Memory, Swap and PidsLimit limit the build container, zero is
+	// unlimited. Swap is in addition to Memory
+	Memory                 int64
+	Swap                   int64
+	PidsLimit              int64
 	Uid					   string
 	Gid					   string
+	Profiles               []Profile
+	// Runtime is the container engine to use, see Runtimes
+	Runtime                string
+	// PodmanURL is a running podman service to use instead of starting one
+	PodmanURL              string
 }
 
 
+// SupportedDevices is used by the templates to render per device settings.
+func (c *DockerStackConfig) SupportedDevices() []devices.Device {
+	return devices.Supported
+}
+
 type DockerStack struct {
 	config *DockerStackConfig
 	renderedBuildScript []byte
 	buildScriptFileLocation string
-	ctx context.Context
+	runtime Runtime
 	statePath string
 	scriptPath string
 	keysPath string
 	logsPath string
 	buildPath string
 	releasePath string
-	podmanProc *exec.Cmd
 	renderedDockerFile []byte
+	attestationPath string
 	stopTimeout uint
+	progress subscribers
+	// profile is nil for the default profile configured at the top level
+	profile *Profile
 }
 
-func blockUntilSocket(timeout int) error {
-	for i := 0; i<timeout; i++ {
-		_, err := os.Stat(sockPath)
-		if os.IsExist(err) {
-			return nil
-		}
-		time.Sleep(1*time.Second)
-	}
-	return fmt.Errorf("reached timeout", )
+// StateDir returns the directory localstack keeps its own files in for a
+// given state path.
+func StateDir(statePath string) string {
+	return path.Join(path.Clean(statePath), ".localstack")
 }
 
-func startPodman(sockpath string) (string, *exec.Cmd, error) {
-
-	pathstr := fmt.Sprintf("unix://%s", path.Clean(sockpath))
-
-	args := []string{
-		"system",
-		"service",
-		"--timeout",
-		"0",
-		pathstr,
-	}
-	cmd := exec.Command("podman", args...)
-
-	err := cmd.Start()
-
-	if err != nil {
-		return "", nil, err
-	}
-
-	return pathstr, cmd, nil
+// ReleasePath returns the host directory the build container publishes
+// releases to for a given state path.
+func ReleasePath(statePath string) string {
+	return path.Join(StateDir(statePath), "mounts/release")
 }
 
 func NewDockerStack(config *DockerStackConfig) (*DockerStack, error) {
-	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
-		return nil, fmt.Errorf("error: socket path %s exists. Is podman already running?", sockPath)
-	}
-
 	renderedBuildScript, err := utils.RenderTemplate(buildtemplates.BuildTemplate, config)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to render dockerfile: $v", err)
+		return nil, fmt.Errorf("failed to render dockerfile: %v", err)
 	}
 
 	dockerFile, err := utils.RenderTemplate(buildtemplates.DockerTemplate, config)
@@ -128,36 +125,25 @@ func NewDockerStack(config *DockerStackConfig) (*DockerStack, error) {
 		return nil, fmt.Errorf("Failed to render build script %v", err)
 	}
 
-	ctx := context.Background()
-
-	apiurl, proc, err := startPodman(sockPath)
-
-	blockUntilSocket(10)
+	runtime, err := NewRuntime(config)
 
 	if (err != nil) {
-		return nil, fmt.Errorf("failed to start podman daemon: %v", err)
+		return nil, err
 	}
 
-	os.Setenv("DOCKER_HOST", apiurl)
-	os.Setenv("DOCKER_API_VERSION", "1.40")
-	cli, err := bindings.NewConnection(ctx, apiurl)
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to create docker api client: %v", err)
-	}
-	statepath := path.Join(path.Clean(config.StatePath), ".localstack")
+	statepath := StateDir(config.StatePath)
 	stack := &DockerStack{
 		config:	config,
 		renderedBuildScript: renderedBuildScript,
-		ctx: cli,
+		runtime: runtime,
 		statePath: statepath,
-		podmanProc: proc,
 		renderedDockerFile: dockerFile,
 		scriptPath: path.Join(statepath, "mounts/script"),
 		keysPath: path.Join(statepath, "mounts/keys"),
-		logsPath: path.Join(statepath, "mounts/logs"),
-		releasePath: path.Join(statepath, "mounts/release"),
+		logsPath: LogsPath(config.StatePath),
+		releasePath: ReleasePath(config.StatePath),
 		buildPath: path.Join(statepath, "build-ubuntu"),
+		attestationPath: path.Join(statepath, "attestation"),
 		stopTimeout: containerStopTimeout,
 	}
 
@@ -165,17 +151,29 @@ func NewDockerStack(config *DockerStackConfig) (*DockerStack, error) {
 }
 
 func (s *DockerStack) Shutdown() error {
-	err := s.stopContainer()
+	if detachedBuildRunning(s.config.StatePath, s.Name()) {
+		log.Infof("leaving build container of %s running for a detached build", s.Name())
+	} else if s.containerExists() {
+		err := s.stopContainer()
 
-	if err != nil {
-		log.Warnf("warning: failed to stop container on shutdown: %v", err)
+		if err != nil {
+			log.Warnf("warning: failed to stop container on shutdown: %v", err)
+		}
 	}
 
-	_ = s.podmanProc.Process.Kill()
+	s.progress.close()
+
+	// stacks of named profiles share the runtime of their parent
+	if s.profile != nil {
+		return nil
+	}
 
-	_ = s.podmanProc.Wait()
+	if detachedBuildsRunning(s.config.StatePath) {
+		log.Info("leaving container runtime running for detached builds")
+		return nil
+	}
 
-	return nil
+	return s.runtime.Close()
 }
 
 func (s *DockerStack) setupTmpDir() error {
@@ -186,6 +184,14 @@ func (s *DockerStack) setupTmpDir() error {
 	os.MkdirAll(s.keysPath, 0700)
 	os.MkdirAll(s.logsPath, 0700)
 	os.MkdirAll(s.releasePath, 0700)
+	// created here so the index is not owned by root with a rootful runtime
+	os.MkdirAll(path.Join(s.releasePath, releaseIndexDir), 0700)
+
+	for _, v := range ota.Variants {
+		if dir := ota.VariantDir(v); dir != "" {
+			os.MkdirAll(path.Join(s.releasePath, dir), 0700)
+		}
+	}
 
 	ibd, err := os.Create(path.Join(s.statePath, "build-ubuntu/install-build-deps.sh"))
 
@@ -231,38 +237,388 @@ func (s *DockerStack) setupTmpDir() error {
 	tar.Create(path.Join(s.statePath, "build-ubuntu.tar"))
 	tar.AddAll(path.Join(s.statePath, "build-ubuntu"), true)
 	tar.Close()
+
+	if s.config.EnableAttestation {
+		return s.setupAttestationDir()
+	}
+
+	return nil
+}
+
+func (s *DockerStack) setupAttestationDir() error {
+	os.MkdirAll(s.attestationPath, 0700)
+
+	dockerfile, err := utils.RenderTemplate(buildtemplates.AttestationDockerTemplate, s.config)
+
+	if err != nil {
+		return fmt.Errorf("failed to render attestation dockerfile: %v", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(s.attestationPath, "Dockerfile"), dockerfile, 0600)
+
+	if err != nil {
+		return fmt.Errorf("failed to write attestation dockerfile: %v", err)
+	}
+
+	entrypoint, err := utils.RenderTemplate(buildtemplates.AttestationEntrypoint, s.config)
+
+	if err != nil {
+		return fmt.Errorf("failed to render attestation entrypoint: %v", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(s.attestationPath, "entrypoint.sh"), entrypoint, 0600)
+
+	if err != nil {
+		return fmt.Errorf("failed to write attestation entrypoint: %v", err)
+	}
+
 	return nil
 }
 
 func (s *DockerStack) containerExists() bool {
-	container, err := containers.Inspect(s.ctx, containerName, nil)
+	return s.runtime.ContainerExists(s.containerName())
+}
 
-	return container != nil && err == nil
+// BuildOptions are the per-build arguments passed to the build script.
+type BuildOptions struct {
+	// Force skips the version check and forces a complete rebuild
+	Force bool
+	// AOSPBuild pins the AOSP build id (e.g. RP1A.201005.004), defaults to
+	// the build the vendor files are published for
+	AOSPBuild string
+	// AOSPBranch pins the AOSP tag to sync, defaults to the tag matching the
+	// vendor build
+	AOSPBranch string
+	// Resume skips steps that already completed with the same input versions
+	Resume bool
+	// FromStep skips every step before it
+	FromStep string
+	// OnlyStep runs just this step after the setup steps
+	OnlyStep string
+	// KeysPassphrase unseals the signing keys when EncryptedKeys is set
+	KeysPassphrase string
+	// RotateKeys signs the build with a new key set and the OTA with the old
+	// releasekey, then archives the old keys
+	RotateKeys bool
+	// RotateAVB also replaces the AVB key during a key rotation
+	RotateAVB bool
+	// NoStdin doesn't attach the terminal to the build, for builds running
+	// alongside others
+	NoStdin bool
+	// Detach starts the build in the background and returns, see
+	// DetachedBuild
+	Detach bool
+	// Channel is the release channel to publish to, defaults to the channel
+	// of the profile or dev
+	Channel string
+	// Variant is the build variant, defaults to the variant of the profile
+	// or the stack
+	Variant string
 }
 
-func (s *DockerStack) Build(force bool) error {
-	args := []string{"bash", "/script/build.sh", s.config.Device, strconv.FormatBool(force)}
-	return s.containerExec(args, []string{}, false, true)
+// BuildSteps are the steps of the build script in the order they run, see
+// BUILD_STEPS in buildtemplates.BuildTemplate.
+var BuildSteps = []string{
+	"get_latest_versions",
+	"check_for_new_versions",
+	"initial_key_setup",
+	"setup_env",
+	"aws_import_keys",
+	"check_chromium",
+	"aosp_repo_init",
+	"aosp_repo_modifications",
+	"aosp_repo_sync",
+	"setup_vendor",
+	"build_fdroid",
+	"add_chromium",
+	"apply_patches",
+	"build_aosp",
+	"release",
+	"aws_upload",
+	"checkpoint_versions",
+	"finish_key_rotation",
 }
 
-func (s *DockerStack) setupVolume(name string) error {
-	resp, err := volumes.Inspect(s.ctx, name)
+// SetupSteps only set up state for the rest of the build and always run, see
+// SETUP_STEPS in buildtemplates.BuildTemplate.
+var SetupSteps = []string{
+	"get_latest_versions",
+	"check_for_new_versions",
+	"initial_key_setup",
+	"setup_env",
+	"aws_import_keys",
+}
 
-	if err != nil || resp == nil {
-		_, err := volumes.Create(s.ctx, entities.VolumeCreateOptions{
-			Name: name,
-		})
+func isBuildStep(step string) bool {
+	for _, s := range BuildSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func isSetupStep(step string) bool {
+	for _, s := range SetupSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectableSteps returns the steps a build can start at or be limited to.
+func SelectableSteps() []string {
+	steps := []string{}
+
+	for _, s := range BuildSteps {
+		if !isSetupStep(s) {
+			steps = append(steps, s)
+		}
+	}
+
+	return steps
+}
+
+// checkSelectableStep returns an error unless --from-step or --only-step
+// can select step. Setup steps always run and never end skipping.
+func checkSelectableStep(step string) error {
+	if !isBuildStep(step) {
+		return fmt.Errorf("unknown build step %s", step)
+	}
+
+	if isSetupStep(step) {
+		return fmt.Errorf("%s is a setup step that always runs, choose one of %s", step, strings.Join(SelectableSteps(), ", "))
+	}
+
+	return nil
+}
+
+// KeysConfig are the parameters new signing keys are generated with.
+type KeysConfig struct {
+	// Subject is the certificate subject in openssl form, e.g. /O=Example/CN=Example
+	Subject string
+	// RSASize is the size of the platform keys made with make_key
+	RSASize int `mapstructure:"rsa-size"`
+	// AVBRSASize is the size of the AVB key and the chromium keystore
+	AVBRSASize int `mapstructure:"avb-rsa-size"`
+	// Validity of the certificates in days
+	Validity int
+	// KeystorePasswordFile holds the password of chromium.keystore, which
+	// is "chromium" if unset
+	KeystorePasswordFile string `mapstructure:"keystore-password-file"`
+}
+
+// keysSecrets returns the secrets protecting the keys by the name of the file
+// the build script reads them from.
+func (s *DockerStack) keysSecrets(opts *BuildOptions) (map[string]string, error) {
+	secrets := map[string]string{}
+
+	if s.config.EncryptedKeys {
+		secrets["keys-passphrase"] = opts.KeysPassphrase
+	}
+
+	// the build script signs chromium with the password in a file, never
+	// on the command line
+	secrets["keystore-password"] = "chromium"
+
+	if s.config.Keys.KeystorePasswordFile != "" {
+		data, err := ioutil.ReadFile(s.config.Keys.KeystorePasswordFile)
 
 		if err != nil {
-			return fmt.Errorf("Error, failed to create volume %v", err)
+			return nil, fmt.Errorf("failed to read keystore password: %v", err)
+		}
+
+		secrets["keystore-password"] = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return secrets, nil
+}
+
+// writeSecretsScript writes a line of stdin to the file named by each argument
+// after the directory, only readable by the build user
+const writeSecretsScript = `dir="$1"; shift; umask 077; chown build:build "${dir}" || exit 1
+for name in "$@"; do IFS= read -r secret && printf '%s' "${secret}" > "${dir}/${name}" && chown build:build "${dir}/${name}" || exit 1; done`
+
+// writeSecrets writes the secrets to the in memory filesystem of the build
+// container, one line each on stdin of an exec. Secrets are never passed in
+// the environment, where they would show up in inspect and /proc.
+func (s *DockerStack) writeSecrets(secrets map[string]string) error {
+	names := []string{}
+	input := &strings.Builder{}
+
+	for name, secret := range secrets {
+		if strings.ContainsAny(secret, "\r\n") {
+			return fmt.Errorf("%s must be a single line", name)
+		}
+
+		names = append(names, name)
+		input.WriteString(secret + "\n")
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    append([]string{"bash", "-c", writeSecretsScript, "secrets", secretsTmpfsPath}, names...),
+		User:   "root",
+		Stdin:  strings.NewReader(input.String()),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to write secrets: %v", err)
+	}
+
+	if code != 0 {
+		return fmt.Errorf("failed to write secrets, exited with %d", code)
+	}
+
+	return nil
+}
+
+// Build runs the build script in the build container. Cancelling ctx stops
+// the build, giving it stopTimeout to clean up.
+func (s *DockerStack) Build(ctx context.Context, opts *BuildOptions) error {
+	aospBranch := opts.AOSPBranch
+
+	if aospBranch == "" && s.profile != nil {
+		aospBranch = s.profile.AOSPBranch
+	}
+
+	args := []string{
+		"bash",
+		"/script/build.sh",
+		s.Device(),
+		strconv.FormatBool(opts.Force),
+		opts.AOSPBuild,
+		aospBranch,
+	}
+
+	secrets, err := s.keysSecrets(opts)
+
+	if err != nil {
+		return err
+	}
+
+	env := []string{}
+	channel := opts.Channel
+	variant := opts.Variant
+
+	if s.profile != nil {
+		env = append(env, "PROFILE="+s.profile.Name)
+
+		if channel == "" {
+			channel = s.profile.Channel
+		}
+
+		if variant == "" {
+			variant = s.profile.Variant
+		}
+	}
+
+	if channel != "" {
+		env = append(env, "BUILD_CHANNEL="+channel)
+	}
+
+	if variant == "" {
+		variant = s.config.Variant
+	}
+
+	if variant != "" {
+		env = append(env, "BUILD_TYPE="+variant)
+	}
+
+	if opts.RotateKeys {
+		env = append(env, "ROTATE_KEYS=true")
+
+		if opts.RotateAVB {
+			env = append(env, "ROTATE_AVB=true")
+		}
+	}
+
+	if opts.Resume {
+		env = append(env, "RESUME_BUILD=true")
+	}
+
+	if opts.FromStep != "" {
+		if err := checkSelectableStep(opts.FromStep); err != nil {
+			return err
 		}
+		env = append(env, "FROM_STEP="+opts.FromStep)
+	}
+
+	if opts.OnlyStep != "" {
+		if err := checkSelectableStep(opts.OnlyStep); err != nil {
+			return err
+		}
+		env = append(env, "ONLY_STEP="+opts.OnlyStep)
+	}
+
+	err = s.containerExec(ctx, args, env, secrets, opts.Detach, !opts.NoStdin)
+
+	if err != nil {
+		return err
+	}
+
+	if s.config.Remote() && !opts.Detach {
+		return s.syncRelease()
 	}
 
 	return nil
 }
 
+// GenerateKeys runs just the key setup of the build script, generating the
+// signing keys of the device if there are none yet.
+func (s *DockerStack) GenerateKeys(ctx context.Context, opts *BuildOptions) error {
+	args := []string{
+		"bash",
+		"/script/build.sh",
+		s.Device(),
+		"false",
+		"",
+		opts.AOSPBranch,
+	}
+
+	secrets, err := s.keysSecrets(opts)
+
+	if err != nil {
+		return err
+	}
+
+	return s.containerExec(ctx, args, []string{"KEYS_ONLY=true"}, secrets, false, !opts.NoStdin)
+}
+
+// WithKeysDir runs fn on a host directory holding the keys volume. fn may only
+// change the keys if write is set.
+func (s *DockerStack) WithKeysDir(write bool, fn func(dir string) error) error {
+	if s.config.Remote() {
+		return fmt.Errorf("the keys volume %s is on the build host %s", s.KeysVolume(), s.config.PodmanURL)
+	}
+
+	err := s.setupVolume(s.KeysVolume())
+
+	if err != nil {
+		return err
+	}
+
+	return s.runtime.WithVolume(s.KeysVolume(), write, fn)
+}
+
+// Subscribe returns a channel receiving the progress of every build step
+// run by this stack. The channel is closed on Shutdown.
+func (s *DockerStack) Subscribe() <-chan StepEvent {
+	return s.progress.add()
+}
+
+func (s *DockerStack) setupVolume(name string) error {
+	return s.runtime.EnsureVolume(name)
+}
+
 func (s *DockerStack) setupVolumes() error {
-	err := s.setupVolume(buildVolumeName)
+	err := s.setupVolume(s.BuildVolume())
 
 	if err != nil {
 		return err
@@ -280,7 +636,13 @@ func (s *DockerStack) setupVolumes() error {
 		return err
 	}
 
-	err = s.setupVolume(keysVolumeName)
+	err = s.setupVolume(logsVolumeName)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.setupVolume(s.KeysVolume())
 
 	if err != nil {
 		return err
@@ -292,13 +654,12 @@ func (s *DockerStack) setupVolumes() error {
 func (s *DockerStack) stopContainer() error {
 	log.Info("stopping build container")
 
-	return containers.Stop(s.ctx, containerName, &s.stopTimeout)
+	return s.runtime.StopContainer(s.containerName(), s.stopTimeout)
 }
 
-func (s *DockerStack) containerExec(args []string, env []string, async bool, stdin bool) error {
-	log.Info("starting localstack build")
-
-
+// startContainer replaces the build container of this stack with a new one
+// running the build image.
+func (s *DockerStack) startContainer() error {
 	err := s.setupVolumes()
 
 	if err != nil {
@@ -308,133 +669,270 @@ func (s *DockerStack) containerExec(args []string, env []string, async bool, std
 	exist := s.containerExists()
 
 	if exist {
-		var volume = false
-
 		err = s.stopContainer()
 
 		if err != nil {
 			return fmt.Errorf("failed to stop container before remove: %v", err)
 		}
 
-		containers.Remove(s.ctx, containerName, nil, &volume)
+		s.runtime.RemoveContainer(s.containerName(), false)
 	}
 
 	log.Info("Starting container")
-	spec := specgen.NewSpecGenerator(imageTag, false)
 
-	releasemount := specs.Mount{
-		Destination: "/release",
-		Source: s.releasePath,
-		Type: "bind",
+	spec := &ContainerSpec{
+		Name: s.containerName(),
+		Image: imageTag,
+		Terminal: true,
+		Resources: Resources{
+			CPUs: s.config.NumProc,
+			Memory: s.config.Memory,
+			Swap: s.config.Swap,
+			Pids: s.config.PidsLimit,
+		},
+		Mounts: []Mount{
+			{Type: MountVolume, Source: s.BuildVolume(), Destination: "/build"},
+			{Type: MountVolume, Source: s.KeysVolume(), Destination: "/keys"},
+		},
 	}
 
-	buildvol := specgen.NamedVolume{
-		Name: buildVolumeName,
-		Dest: "/build",
+	if s.config.Remote() {
+		spec.Mounts = append(spec.Mounts,
+			Mount{Type: MountVolume, Source: releaseVolumeName, Destination: "/release"},
+			Mount{Type: MountVolume, Source: logsVolumeName, Destination: "/logs"},
+		)
+	} else {
+		spec.Mounts = append(spec.Mounts,
+			Mount{Type: MountBind, Source: s.releasePath, Destination: "/release"},
+			Mount{Type: MountBind, Source: s.logsPath, Destination: "/logs"},
+		)
+	}
+
+	spec.Mounts = append(spec.Mounts, Mount{
+		Type: MountTmpfs,
+		Destination: secretsTmpfsPath,
+		TmpfsSize: 1 << 20,
+		TmpfsMode: 0700,
+	})
+
+	if s.config.EncryptedKeys {
+		// unsealed keys never touch the build volume
+		spec.Mounts = append(spec.Mounts, Mount{
+			Type: MountTmpfs,
+			Destination: keysTmpfsPath,
+			TmpfsSize: 64 << 20,
+			TmpfsMode: 0700,
+		})
 	}
 
-	keysvol := specgen.NamedVolume{
-		Name: keysVolumeName,
-		Dest: "/keys",
+	return s.runtime.RunContainer(spec)
+}
+
+func (s *DockerStack) containerExec(ctx context.Context, args []string, env []string, secrets map[string]string, async bool, stdin bool) error {
+	log.Info("starting localstack build")
+
+	if ctx.Err() != nil {
+		return ErrCancelled
 	}
 
-	spec.Terminal = true
-	spec.Name = containerName
-	spec.Volumes = []*specgen.NamedVolume{&buildvol, &keysvol}
-	spec.Mounts = []specs.Mount{releasemount}
+	if async && s.config.Remote() {
+		return fmt.Errorf("detached builds are not supported on a remote build host")
+	}
+
+	if detachedBuildRunning(s.config.StatePath, s.Name()) {
+		return fmt.Errorf("a detached build of %s is still running, see localstack status", s.Name())
+	}
 
-	resp, err := containers.CreateWithSpec(s.ctx, spec)
+	err := s.startContainer()
 
 	if err != nil {
-		return fmt.Errorf("error creating container: %v", err)
+		return err
 	}
 
-	err = containers.Start(s.ctx, resp.ID, nil)
+	err = s.writeSecrets(secrets)
 
 	if err != nil {
-		return fmt.Errorf("failed to start container: %v", err)
+		return err
 	}
 
-	running := define.ContainerStateRunning
+	os.MkdirAll(s.logsPath, 0700)
+
+	buildID := newBuildLogID(s.Name())
+
+	if async {
+		return s.execDetached(buildID, args, env)
+	}
 
-	_, err = containers.Wait(s.ctx, resp.ID, &running)
+	logfile, err := os.Create(path.Join(s.logsPath, buildID+logSuffix))
 
 	if err != nil {
-		return fmt.Errorf("failed to wait for container: %v", err)
+		return fmt.Errorf("failed to create build log: %v", err)
 	}
 
-	opts := handlers.ExecCreateConfig{
-		types.ExecConfig{
-			AttachStderr: true,
-			AttachStdout: true,
-			AttachStdin: true,
-			Env: env,
-			Cmd: args,
-		},
+	defer logfile.Close()
+
+	log.Infof("writing build log to %s", logfile.Name())
+
+	execspec := &ExecSpec{
+		Cmd: append([]string{"setsid", "--wait", "bash", "-c", launchScript, "build"}, args[1:]...),
+		Env: append(env, "LOCALSTACK_EVENTS=/logs/"+buildID+eventsSuffix, "LOCALSTACK_PGID="+buildPgidFile),
+		Stdout: io.MultiWriter(os.Stdout, logfile),
+		Stderr: io.MultiWriter(os.Stderr, logfile),
 	}
 
-	exec, err := containers.ExecCreate(s.ctx, containerName, &opts)
+	if stdin {
+		execspec.Stdin = os.Stdin
+	}
 
-	if err != nil {
-		return fmt.Errorf("ExecCreate failed: %v", err)
+	var stopMirror func()
+
+	if s.config.Remote() {
+		// the events are written on the build host, follow them from there
+		stopMirror, err = s.mirrorEvents("/logs/"+buildID+eventsSuffix, path.Join(s.logsPath, buildID+eventsSuffix))
+
+		if err != nil {
+			log.Warnf("failed to follow build events on build host: %v", err)
+		}
 	}
 
+	tail := newEventTail(path.Join(s.logsPath, buildID+eventsSuffix), s.progress.publish)
+
+	code, err := s.runExec(ctx, execspec)
+
+	if s.config.Remote() {
+		if stopMirror != nil {
+			stopMirror()
+		}
 
-	attachopts := define.AttachStreams{
-		OutputStream: os.Stdout,
-		ErrorStream: os.Stderr,
-		InputStream: bufio.NewReader(os.Stdin),
-		AttachOutput: true,
-		AttachError: true,
-		AttachInput: true,
+		// pick up the events written after the mirror stopped
+		ferr := s.fetchFile("/logs/"+buildID+eventsSuffix, path.Join(s.logsPath, buildID+eventsSuffix))
+
+		if ferr != nil {
+			log.Warnf("failed to copy build events from build host: %v", ferr)
+		}
 	}
 
-	err = containers.ExecStartAndAttach(s.ctx, exec, &attachopts)
+	tail.Close()
 
 	if err != nil {
-		return fmt.Errorf("Failed to attach to container: %v", err)
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("build script exited with %d, see log %s", code, buildID)
 	}
 
 	return nil
 }
 
-func (s *DockerStack) Apply() error {
-	//TODO: deploy docker envionment
-	log.Info("deploying docker client")
-	s.setupTmpDir()
-	commonOpts := buildah.CommonBuildOptions{
-		//TODO: volumes
+func (s *DockerStack) buildImage(ctx context.Context, contextDir string, tag string) error {
+	return s.runtime.BuildImage(ctx, contextDir, tag)
+}
+
+// deployAttestation (re)creates the attestation server container. It pins the
+// verified boot keys of the default profile and of every named profile, each
+// keys volume is mounted at /keys/<n> and listed in KEY_SETS as <n>/<device>.
+// It is left running after localstack exits.
+func (s *DockerStack) deployAttestation(ctx context.Context) error {
+	log.Info("deploying attestation server")
+
+	err := s.buildImage(ctx, s.attestationPath, attestationImageTag)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.setupVolume(attestationVolumeName)
+
+	if err != nil {
+		return err
+	}
+
+	mounts := []Mount{
+		{Type: MountVolume, Source: attestationVolumeName, Destination: "/data"},
+	}
+	keySets := []string{}
+
+	addKeys := func(volume string, device string) error {
+		if err := s.setupVolume(volume); err != nil {
+			return err
+		}
+
+		n := strconv.Itoa(len(keySets))
+		mounts = append(mounts, Mount{Type: MountVolume, Source: volume, Destination: "/keys/" + n, ReadOnly: true})
+		keySets = append(keySets, n+"/"+device)
+
+		return nil
 	}
 
-	imageBuildah := imagebuildah.BuildOptions{
-		ContextDirectory: path.Join(s.statePath, "build-ubuntu"),
-		PullPolicy: buildah.PullIfNewer,
-		Quiet: false,
-		Isolation: buildah.IsolationOCIRootless,
-		Compression: archive.Gzip,
-		Output: imageTag,
-		Log: log.Infof,
-		In: os.Stdin,
-		Out: os.Stdout,
-		ReportWriter: os.Stdout,
-		CommonBuildOpts: &commonOpts,
-		NoCache: false,
-		Layers: true,
-		Squash: false,
-		RemoveIntermediateCtrs: false,
-		ForceRmIntermediateCtrs: false,
+	if err := addKeys(keysVolumeName, s.config.Device); err != nil {
+		return err
 	}
 
-	buildoptions := entities.BuildOptions{
-		imageBuildah,
+	for _, p := range s.config.Profiles {
+		profile, err := s.Profile(p.Name)
+
+		if err != nil {
+			return err
+		}
+
+		if err := addKeys(profile.KeysVolume(), profile.Device()); err != nil {
+			return err
+		}
 	}
 
-	containerfile := []string{path.Join(s.statePath, "build-ubuntu/Dockerfile")}
+	if s.runtime.ContainerExists(attestationContainerName) {
+		err = s.runtime.RemoveContainer(attestationContainerName, true)
 
-	_, err := images.Build(s.ctx, containerfile, buildoptions)
+		if err != nil {
+			return fmt.Errorf("failed to remove old attestation container: %v", err)
+		}
+	}
+
+	spec := &ContainerSpec{
+		Name: attestationContainerName,
+		Image: attestationImageTag,
+		Env: map[string]string{"KEY_SETS": strings.Join(keySets, " ")},
+		Mounts: mounts,
+		Ports: []PortMapping{
+			{
+				HostPort: uint16(s.config.AttestationPort),
+				ContainerPort: attestationContainerPort,
+			},
+		},
+	}
+
+	err = s.runtime.RunContainer(spec)
 
 	if err != nil {
-		return fmt.Errorf("failed to build image: %v", err)
+		return fmt.Errorf("failed to run attestation container: %v", err)
 	}
+
+	log.Infof("attestation server listening on port %d", s.config.AttestationPort)
+
+	return nil
+}
+
+// Apply builds the build image and deploys the attestation server. Cancelling
+// ctx stops the image build.
+func (s *DockerStack) Apply(ctx context.Context) error {
+	//TODO: deploy docker envionment
+	log.Info("deploying docker client")
+	err := s.setupTmpDir()
+
+	if err != nil {
+		return err
+	}
+
+	err = s.buildImage(ctx, path.Join(s.statePath, "build-ubuntu"), imageTag)
+
+	if err != nil {
+		return err
+	}
+
+	if s.config.EnableAttestation {
+		return s.deployAttestation(ctx)
+	}
+
 	return nil
 }
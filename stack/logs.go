@@ -0,0 +1,174 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	logTimeFormat = "2006-01-02_15-04-05"
+	logSuffix     = ".log"
+)
+
+// BuildLog is the captured output of a single build.
+type BuildLog struct {
+	ID string
+	// Target is the profile, or the device for the default profile, built
+	Target  string
+	Path    string
+	Started time.Time
+	Size    int64
+}
+
+// LogsPath returns the host directory build logs are written to for a given
+// state path.
+func LogsPath(statePath string) string {
+	return path.Join(StateDir(statePath), "mounts/logs")
+}
+
+// newBuildLogID names a build log after the time it started and the
+// target built, so concurrent builds of different profiles don't collide.
+func newBuildLogID(target string) string {
+	return time.Now().Format(logTimeFormat) + "_" + target
+}
+
+// ListBuildLogs returns the logs of past builds, oldest first.
+func ListBuildLogs(statePath string) ([]BuildLog, error) {
+	dir := LogsPath(statePath)
+	files, err := ioutil.ReadDir(dir)
+
+	if os.IsNotExist(err) {
+		return []BuildLog{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read logs directory: %v", err)
+	}
+
+	logs := []BuildLog{}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), logSuffix) {
+			continue
+		}
+
+		id := strings.TrimSuffix(f.Name(), logSuffix)
+
+		if len(id) < len(logTimeFormat) {
+			continue
+		}
+
+		started, err := time.ParseInLocation(logTimeFormat, id[:len(logTimeFormat)], time.Local)
+
+		if err != nil {
+			continue
+		}
+
+		logs = append(logs, BuildLog{
+			ID:      id,
+			Target:  strings.TrimPrefix(id[len(logTimeFormat):], "_"),
+			Path:    path.Join(dir, f.Name()),
+			Started: started,
+			Size:    f.Size(),
+		})
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Started.Before(logs[j].Started)
+	})
+
+	return logs, nil
+}
+
+// FindBuildLog looks up a build log by id. An empty id or "latest" returns the
+// most recent build.
+func FindBuildLog(statePath string, id string) (*BuildLog, error) {
+	logs, err := ListBuildLogs(statePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("no build logs found in %s", LogsPath(statePath))
+	}
+
+	if id == "" || id == "latest" {
+		return &logs[len(logs)-1], nil
+	}
+
+	for i := range logs {
+		if logs[i].ID == id {
+			return &logs[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no build log with id %s", id)
+}
+
+// buildExited reports whether the build writing the log at logPath has
+// exited: the build script recorded its exit event or, if it was killed, the
+// wrapper of a detached build its exit code.
+func buildExited(logPath string) bool {
+	base := strings.TrimSuffix(logPath, logSuffix)
+
+	if _, err := os.Stat(base + exitSuffix); err == nil {
+		return true
+	}
+
+	events, err := ioutil.ReadFile(base + eventsSuffix)
+
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(events), "\n") {
+		if event, err := parseStepEvent(line); err == nil && event.Kind == BuildExited {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FollowLog copies the log at path to w and keeps copying whatever is
+// appended to it until the build exits or ctx is cancelled.
+func FollowLog(ctx context.Context, path string, w io.Writer) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+
+	defer f.Close()
+
+	exited := false
+
+	for {
+		// the output of a build may reach the log after its exit event,
+		// copy once more after the build exited
+		last := exited
+		exited = buildExited(path)
+
+		if _, err := io.Copy(w, f); err != nil {
+			return fmt.Errorf("failed to read log: %v", err)
+		}
+
+		if last {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
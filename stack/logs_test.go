@@ -0,0 +1,81 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFollowLogStopsAtExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localstack-logs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	logPath := path.Join(dir, "2020-10-17_03-00-00_crosshatch"+logSuffix)
+	eventsPath := path.Join(dir, "2020-10-17_03-00-00_crosshatch"+eventsSuffix)
+
+	if err := ioutil.WriteFile(logPath, []byte("building\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(eventsPath, []byte("1602903600 start build_aosp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out := &bytes.Buffer{}
+	done := make(chan error, 1)
+
+	go func() {
+		done <- FollowLog(ctx, logPath, out)
+	}()
+
+	time.Sleep(time.Second)
+
+	select {
+	case <-done:
+		t.Fatal("FollowLog returned while the build is running")
+	default:
+	}
+
+	f, err := os.OpenFile(eventsPath, os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString("1602903700 end build_aosp\n1602903700 exit 0\n")
+	f.Close()
+
+	// output written right after the exit event still has to be printed
+	f, err = os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString("done\n")
+	f.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.Err() != nil {
+		t.Fatal("FollowLog didn't return after the build exited")
+	}
+
+	if out.String() != "building\ndone\n" {
+		t.Errorf("FollowLog printed %q, want %q", out.String(), "building\ndone\n")
+	}
+}
@@ -0,0 +1,470 @@
+package stack
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containers/buildah"
+	"github.com/containers/buildah/imagebuildah"
+	"github.com/containers/podman/v2/libpod/define"
+	"github.com/containers/podman/v2/pkg/api/handlers"
+	"github.com/containers/podman/v2/pkg/bindings"
+	"github.com/containers/podman/v2/pkg/bindings/containers"
+	"github.com/containers/podman/v2/pkg/bindings/images"
+	"github.com/containers/podman/v2/pkg/bindings/volumes"
+	"github.com/containers/podman/v2/pkg/domain/entities"
+	"github.com/containers/podman/v2/pkg/specgen"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// podmanRuntime talks to a podman service, either one given by podman-url or
+// one it starts itself.
+type podmanRuntime struct {
+	ctx context.Context
+	// proc is nil if the service is managed outside of localstack
+	proc *os.Process
+}
+
+// PodmanURLSchemes are the schemes accepted in podman-url.
+var PodmanURLSchemes = []string{"unix", "ssh"}
+
+// DefaultPodmanSocket returns the socket localstack starts its own podman
+// service on if podman-url is not set. It lives in the user's runtime
+// directory, or in ~/.localstack if there is none.
+func DefaultPodmanSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return path.Join(dir, "localstack", "podman.sock")
+	}
+
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		home = "."
+	}
+
+	return path.Join(home, ".localstack", "podman.sock")
+}
+
+func blockUntilSocket(sockpath string, timeout int) error {
+	for i := 0; i < timeout; i++ {
+		if _, err := os.Stat(sockpath); err == nil {
+			return nil
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return fmt.Errorf("reached timeout")
+}
+
+func startPodman(sockpath string) (string, *exec.Cmd, error) {
+
+	pathstr := fmt.Sprintf("unix://%s", path.Clean(sockpath))
+
+	args := []string{
+		"system",
+		"service",
+		"--timeout",
+		"0",
+		pathstr,
+	}
+	cmd := exec.Command("podman", args...)
+	// keep the service alive when the terminal closes, detached builds
+	// still need it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err := cmd.Start()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return pathstr, cmd, nil
+}
+
+// newPodmanRuntime connects to the service at url, or starts one on the
+// default socket if url is empty. identity is the private key used for ssh
+// urls, ssh-agent is used if it is empty.
+func newPodmanRuntime(url string, identity string) (*podmanRuntime, error) {
+	if url != "" {
+		ctx, err := bindings.NewConnectionWithIdentity(context.Background(), url, identity)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to podman at %s: %v", url, err)
+		}
+
+		return &podmanRuntime{
+			ctx: ctx,
+		}, nil
+	}
+
+	return spawnPodman(DefaultPodmanSocket())
+}
+
+func podmanPidFile(sockpath string) string {
+	return path.Join(path.Dir(sockpath), "podman.pid")
+}
+
+// spawnPodman starts a service on sockpath, or takes over the one an earlier
+// run left behind for a detached build.
+func spawnPodman(sockpath string) (*podmanRuntime, error) {
+	if _, err := os.Stat(sockpath); !os.IsNotExist(err) {
+		if ctx, err := bindings.NewConnection(context.Background(), "unix://"+sockpath); err == nil {
+			data, err := ioutil.ReadFile(podmanPidFile(sockpath))
+
+			if err != nil {
+				return nil, fmt.Errorf("error: podman is already listening on %s, set podman-url = \"unix://%s\" to use it", sockpath, sockpath)
+			}
+
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid podman pid file: %v", err)
+			}
+
+			proc, _ := os.FindProcess(pid)
+
+			log.Infof("reusing podman service %d", pid)
+
+			return &podmanRuntime{
+				ctx:  ctx,
+				proc: proc,
+			}, nil
+		}
+
+		log.Warnf("removing stale podman socket %s", sockpath)
+
+		if err := os.Remove(sockpath); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", sockpath, err)
+		}
+	}
+
+	err := os.MkdirAll(path.Dir(sockpath), 0700)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+
+	apiurl, proc, err := startPodman(sockpath)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to start podman daemon: %v", err)
+	}
+
+	blockUntilSocket(sockpath, 10)
+
+	err = ioutil.WriteFile(podmanPidFile(sockpath), []byte(strconv.Itoa(proc.Process.Pid)), 0600)
+
+	if err != nil {
+		log.Warnf("failed to write podman pid file: %v", err)
+	}
+
+	os.Setenv("DOCKER_HOST", apiurl)
+	os.Setenv("DOCKER_API_VERSION", "1.40")
+	ctx, err := bindings.NewConnection(context.Background(), apiurl)
+
+	if err != nil {
+		proc.Process.Kill()
+		proc.Wait()
+		return nil, fmt.Errorf("failed to create docker api client: %v", err)
+	}
+
+	return &podmanRuntime{
+		ctx:  ctx,
+		proc: proc.Process,
+	}, nil
+}
+
+// connCtx carries the podman connection of one context and the cancellation
+// of another.
+type connCtx struct {
+	context.Context
+	conn context.Context
+}
+
+func (c connCtx) Value(key interface{}) interface{} {
+	return c.conn.Value(key)
+}
+
+func (r *podmanRuntime) BuildImage(ctx context.Context, contextDir string, tag string) error {
+	commonOpts := buildah.CommonBuildOptions{
+		//TODO: volumes
+	}
+
+	imageBuildah := imagebuildah.BuildOptions{
+		ContextDirectory:        contextDir,
+		PullPolicy:              buildah.PullIfNewer,
+		Quiet:                   false,
+		Isolation:               buildah.IsolationOCIRootless,
+		Compression:             archive.Gzip,
+		Output:                  tag,
+		Log:                     log.Infof,
+		In:                      os.Stdin,
+		Out:                     os.Stdout,
+		ReportWriter:            os.Stdout,
+		CommonBuildOpts:         &commonOpts,
+		NoCache:                 false,
+		Layers:                  true,
+		Squash:                  false,
+		RemoveIntermediateCtrs:  false,
+		ForceRmIntermediateCtrs: false,
+	}
+
+	buildoptions := entities.BuildOptions{
+		imageBuildah,
+	}
+
+	containerfile := []string{path.Join(contextDir, "Dockerfile")}
+
+	_, err := images.Build(connCtx{ctx, r.ctx}, containerfile, buildoptions)
+
+	if err != nil {
+		return fmt.Errorf("failed to build image %s: %v", tag, err)
+	}
+	return nil
+}
+
+func (r *podmanRuntime) EnsureVolume(name string) error {
+	resp, err := volumes.Inspect(r.ctx, name)
+
+	if err != nil || resp == nil {
+		_, err := volumes.Create(r.ctx, entities.VolumeCreateOptions{
+			Name: name,
+		})
+
+		if err != nil {
+			return fmt.Errorf("Error, failed to create volume %v", err)
+		}
+	}
+
+	return nil
+}
+
+// WithVolume runs fn on the directory backing the volume, a podman volume is
+// owned by the user running podman.
+func (r *podmanRuntime) WithVolume(name string, write bool, fn func(dir string) error) error {
+	resp, err := volumes.Inspect(r.ctx, name)
+
+	if err != nil {
+		return fmt.Errorf("failed to inspect volume %s: %v", name, err)
+	}
+
+	return fn(resp.Mountpoint)
+}
+
+func (r *podmanRuntime) ContainerExists(name string) bool {
+	container, err := containers.Inspect(r.ctx, name, nil)
+
+	return container != nil && err == nil
+}
+
+func (r *podmanRuntime) RunContainer(c *ContainerSpec) error {
+	spec := specgen.NewSpecGenerator(c.Image, false)
+
+	spec.Name = c.Name
+	spec.Terminal = c.Terminal
+	spec.Env = c.Env
+
+	for _, m := range c.Mounts {
+		switch m.Type {
+		case MountVolume:
+			vol := &specgen.NamedVolume{
+				Name: m.Source,
+				Dest: m.Destination,
+			}
+
+			if m.ReadOnly {
+				vol.Options = []string{"ro"}
+			}
+
+			spec.Volumes = append(spec.Volumes, vol)
+		case MountTmpfs:
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: m.Destination,
+				Source:      "tmpfs",
+				Type:        "tmpfs",
+				Options: []string{
+					fmt.Sprintf("size=%d", m.TmpfsSize),
+					fmt.Sprintf("mode=%o", m.TmpfsMode),
+					"nosuid", "nodev", "noexec",
+				},
+			})
+		default:
+			mount := specs.Mount{
+				Destination: m.Destination,
+				Source:      m.Source,
+				Type:        "bind",
+			}
+
+			if m.ReadOnly {
+				mount.Options = []string{"ro"}
+			}
+
+			spec.Mounts = append(spec.Mounts, mount)
+		}
+	}
+
+	spec.ResourceLimits = resourceLimits(c.Resources)
+
+	for _, p := range c.Ports {
+		spec.PortMappings = append(spec.PortMappings, specgen.PortMapping{
+			HostPort:      p.HostPort,
+			ContainerPort: p.ContainerPort,
+		})
+	}
+
+	resp, err := containers.CreateWithSpec(r.ctx, spec)
+
+	if err != nil {
+		return fmt.Errorf("error creating container: %v", err)
+	}
+
+	err = containers.Start(r.ctx, resp.ID, nil)
+
+	if err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+
+	running := define.ContainerStateRunning
+
+	_, err = containers.Wait(r.ctx, resp.ID, &running)
+
+	if err != nil {
+		return fmt.Errorf("failed to wait for container: %v", err)
+	}
+
+	return nil
+}
+
+// cpuPeriod is the CFS period CPU limits are expressed in, in microseconds
+const cpuPeriod = 100000
+
+func resourceLimits(r Resources) *specs.LinuxResources {
+	if r == (Resources{}) {
+		return nil
+	}
+
+	limits := &specs.LinuxResources{}
+
+	if r.CPUs > 0 {
+		quota := int64(r.CPUs) * cpuPeriod
+		period := uint64(cpuPeriod)
+
+		limits.CPU = &specs.LinuxCPU{
+			Quota:  &quota,
+			Period: &period,
+		}
+	}
+
+	if r.Memory > 0 {
+		// the OCI swap limit is memory and swap combined
+		limit := r.Memory
+		swap := r.Memory + r.Swap
+
+		limits.Memory = &specs.LinuxMemory{
+			Limit: &limit,
+			Swap:  &swap,
+		}
+	}
+
+	if r.Pids > 0 {
+		limits.Pids = &specs.LinuxPids{
+			Limit: r.Pids,
+		}
+	}
+
+	return limits
+}
+
+func (r *podmanRuntime) StopContainer(name string, timeout uint) error {
+	return containers.Stop(r.ctx, name, &timeout)
+}
+
+func (r *podmanRuntime) RemoveContainer(name string, force bool) error {
+	var volumes = false
+
+	return containers.Remove(r.ctx, name, &force, &volumes)
+}
+
+// writeCloser lets a plain writer stand in for an attach stream. Closing it
+// is left to the owner of the underlying writers.
+type writeCloser struct {
+	io.Writer
+}
+
+func (w writeCloser) Close() error {
+	return nil
+}
+
+func (r *podmanRuntime) Exec(container string, e *ExecSpec) (int, error) {
+	opts := handlers.ExecCreateConfig{
+		types.ExecConfig{
+			AttachStderr: true,
+			AttachStdout: true,
+			AttachStdin:  e.Stdin != nil,
+			User:         e.User,
+			Env:          e.Env,
+			Cmd:          e.Cmd,
+		},
+	}
+
+	exec, err := containers.ExecCreate(r.ctx, container, &opts)
+
+	if err != nil {
+		return -1, fmt.Errorf("ExecCreate failed: %v", err)
+	}
+
+	attachopts := define.AttachStreams{
+		OutputStream: writeCloser{e.Stdout},
+		ErrorStream:  writeCloser{e.Stderr},
+		AttachOutput: true,
+		AttachError:  true,
+		AttachInput:  e.Stdin != nil,
+	}
+
+	if e.Stdin != nil {
+		attachopts.InputStream = bufio.NewReader(e.Stdin)
+	}
+
+	err = containers.ExecStartAndAttach(r.ctx, exec, &attachopts)
+
+	if err != nil {
+		return -1, fmt.Errorf("Failed to attach to container: %v", err)
+	}
+
+	session, err := containers.ExecInspect(r.ctx, exec)
+
+	if err != nil {
+		return -1, fmt.Errorf("failed to inspect exec session: %v", err)
+	}
+
+	return session.ExitCode, nil
+}
+
+func (r *podmanRuntime) Close() error {
+	// never stop a service localstack didn't start
+	if r.proc == nil {
+		return nil
+	}
+
+	_ = r.proc.Kill()
+
+	// fails for a service taken over from an earlier run, which is not our
+	// child
+	_, _ = r.proc.Wait()
+
+	os.Remove(podmanPidFile(DefaultPodmanSocket()))
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package stack
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var volumeNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// ValidVolumeName reports whether name only has characters allowed in the
+// name of a volume or container, letters, digits, '.', '_' and '-'.
+func ValidVolumeName(name string) bool {
+	return !volumeNameInvalid.MatchString(name)
+}
+
+// Profile is a named build target of a stack. Profiles share the build image
+// and container runtime of the stack but get their own container, keys volume
+// and release channel.
+type Profile struct {
+	Name    string
+	Device  string
+	Channel string
+	// Variant is the build variant, defaults to the variant of the stack
+	Variant string
+	// AOSPBranch pins the AOSP tag for every build of this profile. Profiles
+	// pinned to the same branch share one source volume.
+	AOSPBranch string `mapstructure:"aosp-branch"`
+}
+
+// Profile returns a stack building the named profile. It shares the container
+// runtime of s, shutting it down only stops the profile's container.
+func (s *DockerStack) Profile(name string) (*DockerStack, error) {
+	for i := range s.config.Profiles {
+		p := &s.config.Profiles[i]
+
+		if p.Name != name {
+			continue
+		}
+
+		return &DockerStack{
+			config:              s.config,
+			renderedBuildScript: s.renderedBuildScript,
+			runtime:             s.runtime,
+			statePath:           s.statePath,
+			scriptPath:          s.scriptPath,
+			keysPath:            s.keysPath,
+			logsPath:            s.logsPath,
+			buildPath:           s.buildPath,
+			releasePath:         s.releasePath,
+			renderedDockerFile:  s.renderedDockerFile,
+			attestationPath:     s.attestationPath,
+			stopTimeout:         s.stopTimeout,
+			profile:             p,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no profile named %s", name)
+}
+
+// Name returns the profile name of this stack, or the device it builds for
+// the default profile.
+func (s *DockerStack) Name() string {
+	if s.profile == nil {
+		return s.config.Device
+	}
+	return s.profile.Name
+}
+
+// Device returns the device this stack builds for.
+func (s *DockerStack) Device() string {
+	if s.profile == nil {
+		return s.config.Device
+	}
+	return s.profile.Device
+}
+
+func (s *DockerStack) containerName() string {
+	if s.profile == nil {
+		return containerName
+	}
+	return containerName + "-" + s.profile.Name
+}
+
+// KeysVolume returns the name of the volume holding the signing keys.
+func (s *DockerStack) KeysVolume() string {
+	if s.profile == nil {
+		return keysVolumeName
+	}
+	return keysVolumeName + "-" + s.profile.Name
+}
+
+// BuildVolume returns the name of the volume holding the AOSP source tree.
+// Builds using the same volume can't run at the same time.
+func (s *DockerStack) BuildVolume() string {
+	if s.profile == nil || s.profile.AOSPBranch == "" {
+		return buildVolumeName
+	}
+	return buildVolumeName + "-" + volumeNameInvalid.ReplaceAllString(s.profile.AOSPBranch, "_")
+}
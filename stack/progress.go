@@ -0,0 +1,253 @@
+package stack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventsSuffix      = ".events"
+	eventsPollPeriod  = time.Second
+	subscriberBacklog = 256
+)
+
+// StepEventKind is the type of a progress event emitted by the build script.
+type StepEventKind string
+
+const (
+	StepStarted  StepEventKind = "start"
+	StepFinished StepEventKind = "end"
+	StepFailed   StepEventKind = "fail"
+	StepSkipped  StepEventKind = "skip"
+	// BuildExited is emitted once when the build script exits, Step is empty
+	BuildExited StepEventKind = "exit"
+	// BuildNotify carries a notification sent by aws_notify in Status and
+	// Message
+	BuildNotify StepEventKind = "notify"
+)
+
+// StepEvent reports progress of a single build step.
+type StepEvent struct {
+	Kind     StepEventKind
+	Step     string
+	Time     time.Time
+	ExitCode int
+	Status   string
+	Message  string
+}
+
+// parseStepEvent parses a line written by the event function in the build
+// script: "<unix time> <kind> <step or exit code>" or
+// "<unix time> notify <status> <message>"
+func parseStepEvent(line string) (StepEvent, error) {
+	fields := strings.Fields(line)
+
+	if len(fields) < 2 {
+		return StepEvent{}, fmt.Errorf("malformed event %q", line)
+	}
+
+	ts, err := strconv.ParseInt(fields[0], 10, 64)
+
+	if err != nil {
+		return StepEvent{}, fmt.Errorf("malformed event time %q", fields[0])
+	}
+
+	event := StepEvent{
+		Kind: StepEventKind(fields[1]),
+		Time: time.Unix(ts, 0),
+	}
+
+	switch event.Kind {
+	case StepStarted, StepFinished, StepFailed, StepSkipped:
+		if len(fields) != 3 {
+			return StepEvent{}, fmt.Errorf("malformed step event %q", line)
+		}
+		event.Step = fields[2]
+	case BuildExited:
+		if len(fields) != 3 {
+			return StepEvent{}, fmt.Errorf("malformed exit event %q", line)
+		}
+		event.ExitCode, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return StepEvent{}, fmt.Errorf("malformed exit code %q", fields[2])
+		}
+	case BuildNotify:
+		if len(fields) < 3 {
+			return StepEvent{}, fmt.Errorf("malformed notify event %q", line)
+		}
+		event.Status = fields[2]
+		event.Message = strings.Join(fields[3:], " ")
+	default:
+		return StepEvent{}, fmt.Errorf("unknown event kind %q", fields[1])
+	}
+
+	return event, nil
+}
+
+// EventsPath returns the file the build script reports progress of this build to.
+func (l *BuildLog) EventsPath() string {
+	return strings.TrimSuffix(l.Path, logSuffix) + eventsSuffix
+}
+
+// Events returns the progress events recorded for this build so far.
+func (l *BuildLog) Events() ([]StepEvent, error) {
+	f, err := os.Open(l.EventsPath())
+
+	if os.IsNotExist(err) {
+		return []StepEvent{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events: %v", err)
+	}
+
+	defer f.Close()
+
+	events := []StepEvent{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		event, err := parseStepEvent(scanner.Text())
+
+		if err != nil {
+			log.Debugf("skipping event: %v", err)
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
+
+// eventTail follows an events file while the build is running and hands
+// every event to publish.
+type eventTail struct {
+	path    string
+	publish func(StepEvent)
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newEventTail(path string, publish func(StepEvent)) *eventTail {
+	t := &eventTail{
+		path:    path,
+		publish: publish,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+func (t *eventTail) run() {
+	defer close(t.done)
+
+	var f *os.File
+	var reader *bufio.Reader
+	partial := ""
+
+	for {
+		stopping := false
+
+		select {
+		case <-t.stop:
+			stopping = true
+		case <-time.After(eventsPollPeriod):
+		}
+
+		if f == nil {
+			var err error
+			f, err = os.Open(t.path)
+
+			if err == nil {
+				defer f.Close()
+				reader = bufio.NewReader(f)
+			}
+		}
+
+		for reader != nil {
+			line, err := reader.ReadString('\n')
+			partial += line
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				log.Warnf("failed to read build events: %v", err)
+				break
+			}
+
+			event, err := parseStepEvent(partial)
+			partial = ""
+
+			if err != nil {
+				log.Debugf("skipping event: %v", err)
+				continue
+			}
+
+			t.publish(event)
+		}
+
+		if stopping {
+			return
+		}
+	}
+}
+
+// Close stops following the file after reading everything written so far.
+func (t *eventTail) Close() {
+	close(t.stop)
+	<-t.done
+}
+
+// subscribers fans progress events out to everyone who called Subscribe.
+type subscribers struct {
+	lock     sync.Mutex
+	channels []chan StepEvent
+}
+
+func (s *subscribers) add() <-chan StepEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := make(chan StepEvent, subscriberBacklog)
+	s.channels = append(s.channels, c)
+
+	return c
+}
+
+func (s *subscribers) publish(event StepEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, c := range s.channels {
+		select {
+		case c <- event:
+		default:
+			log.Warnf("dropping progress event for slow subscriber: %s %s", event.Kind, event.Step)
+		}
+	}
+}
+
+func (s *subscribers) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, c := range s.channels {
+		close(c)
+	}
+
+	s.channels = nil
+}
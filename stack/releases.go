@@ -0,0 +1,461 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.io/gnu3ra/localstack/ota"
+)
+
+// releaseIndexDir is the directory of the release mount the build script
+// records every published build in, one file per build.
+const releaseIndexDir = "index"
+
+// ReleaseFile is a file a release published to the release directory.
+type ReleaseFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Release is a build published to the release directory, as recorded in its
+// index by the build script.
+type Release struct {
+	Device  string `json:"device"`
+	Profile string `json:"profile"`
+	// Variant is the build variant, releases recorded without one are user
+	// builds
+	Variant string `json:"variant"`
+	// Channel is the channel the build was published to
+	Channel string `json:"channel"`
+	// Build is the build number, it is part of every file name of the release
+	Build string `json:"build"`
+	// Timestamp is the post-timestamp of the OTA, the second field of the
+	// channel metadata
+	Timestamp int64 `json:"timestamp"`
+	// TrueTimestamp is the time the build started, published as
+	// -true-timestamp
+	TrueTimestamp int64         `json:"true_timestamp"`
+	AOSPBuild     string        `json:"aosp_build"`
+	Chromium      string        `json:"chromium"`
+	FDroidClient  string        `json:"fdroid_client"`
+	FDroidPrivExt string        `json:"fdroid_priv_ext"`
+	Published     int64         `json:"published"`
+	Files         []ReleaseFile `json:"files"`
+}
+
+// BuildVariant returns the build variant of r.
+func (r *Release) BuildVariant() string {
+	if r.Variant == "" {
+		return "user"
+	}
+	return r.Variant
+}
+
+// target identifies the device and variant of r, releases of a target share
+// channels and count against the same retention limit.
+func (r *Release) target() string {
+	return r.Device + "/" + r.BuildVariant()
+}
+
+// PublishedAt returns the time r was published.
+func (r *Release) PublishedAt() time.Time {
+	return time.Unix(r.Published, 0)
+}
+
+// Size returns the combined size of the files of r.
+func (r *Release) Size() int64 {
+	var size int64
+
+	for _, f := range r.Files {
+		size += f.Size
+	}
+
+	return size
+}
+
+// Incremental returns the incremental OTA of r, or "" if it has none.
+func (r *Release) Incremental() string {
+	for _, f := range r.Files {
+		if strings.HasPrefix(path.Base(f.Name), r.Device+"-incremental-") {
+			return path.Base(f.Name)
+		}
+	}
+
+	return ""
+}
+
+// metadata returns the channel metadata pointing the Updater app at r, in the
+// format written by aws_upload.
+func (r *Release) metadata() string {
+	fields := []string{r.Build, strconv.FormatInt(r.Timestamp, 10), r.AOSPBuild}
+
+	if incremental := r.Incremental(); incremental != "" {
+		fields = append(fields, incremental)
+	}
+
+	return strings.Join(fields, " ") + "\n"
+}
+
+func (r *Release) otaFile() string {
+	return path.Join(ota.VariantDir(r.Variant), r.Device+"-ota_update-"+r.Build+".zip")
+}
+
+func (r *Release) channelFile(channel string) string {
+	return path.Join(ota.VariantDir(r.Variant), r.Device+"-"+channel)
+}
+
+func (r *Release) indexFile() string {
+	if dir := ota.VariantDir(r.Variant); dir != "" {
+		return path.Join(releaseIndexDir, r.Device+"-"+dir+"-"+r.Build+".json")
+	}
+	return path.Join(releaseIndexDir, r.Device+"-"+r.Build+".json")
+}
+
+// Releases returns the releases recorded in the index of releasePath, oldest
+// first.
+func Releases(releasePath string) ([]Release, error) {
+	dir := path.Join(releasePath, releaseIndexDir)
+	files, err := ioutil.ReadDir(dir)
+
+	if os.IsNotExist(err) {
+		return []Release{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read release index: %v", err)
+	}
+
+	releases := []Release{}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		r := Release{}
+
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", f.Name(), err)
+		}
+
+		releases = append(releases, r)
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Published < releases[j].Published
+	})
+
+	return releases, nil
+}
+
+// FindRelease returns the release of build. device is the device or profile
+// the release was built for, it may be empty if only one device has a
+// release with that build number.
+func FindRelease(releases []Release, device string, variant string, build string) (*Release, error) {
+	var found *Release
+
+	for i := range releases {
+		r := &releases[i]
+
+		if r.Build != build || r.BuildVariant() != variant || (device != "" && r.Device != device && r.Profile != device) {
+			continue
+		}
+
+		if found != nil && found.Device != r.Device {
+			return nil, fmt.Errorf("several devices have a build %s, pick one with --device", build)
+		}
+
+		found = r
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no %s release of build %s found, see localstack releases list", variant, build)
+	}
+
+	return found, nil
+}
+
+// ChannelRelease returns the release channel points devices at. device is the
+// device or profile to look at, it may be empty if there are releases of only
+// one device.
+func ChannelRelease(releasePath string, releases []Release, device string, variant string, channel string) (*Release, error) {
+	var found *Release
+
+	for i := range releases {
+		r := &releases[i]
+
+		if r.BuildVariant() != variant || (device != "" && r.Device != device && r.Profile != device) {
+			continue
+		}
+
+		if found != nil && found.Device != r.Device {
+			return nil, fmt.Errorf("there are releases of several devices, pick one with --device")
+		}
+
+		found = r
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no %s releases found, see localstack releases list", variant)
+	}
+
+	build, err := PublishedBuild(releasePath, found, channel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if build == "" {
+		return nil, fmt.Errorf("nothing was published to the %s channel of %s", channel, found.Device)
+	}
+
+	return FindRelease(releases, found.Device, variant, build)
+}
+
+// PublishedBuild returns the build the metadata of channel points devices
+// with the device and variant of r at, or "" if nothing was published to it
+// yet.
+func PublishedBuild(releasePath string, r *Release, channel string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(releasePath, r.channelFile(channel)))
+
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s metadata of %s: %v", channel, r.Device, err)
+	}
+
+	fields := strings.Fields(string(data))
+
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	return fields[0], nil
+}
+
+// RetentionPolicy selects the releases localstack releases prune keeps. A
+// release is kept if either limit keeps it.
+type RetentionPolicy struct {
+	// KeepBuilds is the number of newest releases kept of every device
+	KeepBuilds int
+	// KeepDays keeps the releases published in the last days
+	KeepDays int
+}
+
+// Expired returns the releases p doesn't keep, oldest first. Releases
+// published on a channel are always kept, devices are pointed at them.
+func (p *RetentionPolicy) Expired(releasePath string, releases []Release, now time.Time) ([]Release, error) {
+	if p.KeepBuilds <= 0 && p.KeepDays <= 0 {
+		return nil, fmt.Errorf("retention policy keeps every release, set keep-builds or keep-days")
+	}
+
+	published, err := publishedReleases(releasePath, releases)
+
+	if err != nil {
+		return nil, err
+	}
+
+	newer := map[string]int{}
+	expired := []Release{}
+
+	for i := len(releases) - 1; i >= 0; i-- {
+		r := releases[i]
+		newer[r.target()]++
+
+		if published[r.indexFile()] {
+			continue
+		}
+
+		if p.KeepBuilds > 0 && newer[r.target()] <= p.KeepBuilds {
+			continue
+		}
+
+		if p.KeepDays > 0 && now.Sub(r.PublishedAt()) < time.Duration(p.KeepDays)*24*time.Hour {
+			continue
+		}
+
+		expired = append([]Release{r}, expired...)
+	}
+
+	return expired, nil
+}
+
+// publishedReleases returns the index files of the releases a channel points
+// devices at.
+func publishedReleases(releasePath string, releases []Release) (map[string]bool, error) {
+	published := map[string]bool{}
+	checked := map[string]bool{}
+
+	for _, r := range releases {
+		if checked[r.target()] {
+			continue
+		}
+
+		checked[r.target()] = true
+
+		for _, channel := range ota.Channels {
+			build, err := PublishedBuild(releasePath, &r, channel)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if build != "" {
+				published[(&Release{Device: r.Device, Variant: r.Variant, Build: build}).indexFile()] = true
+			}
+		}
+	}
+
+	return published, nil
+}
+
+// PromoteRelease points channel at r, rewriting the channel metadata and
+// -true-timestamp. The OTA of r must not have been pruned.
+func (s *DockerStack) PromoteRelease(r *Release, channel string) error {
+	if !ota.ValidChannel(channel) {
+		return fmt.Errorf("invalid channel %s, must be one of %s", channel, strings.Join(ota.Channels, ", "))
+	}
+
+	if _, err := os.Stat(path.Join(s.releasePath, r.otaFile())); err != nil {
+		return fmt.Errorf("the OTA of build %s is gone: %v", r.Build, err)
+	}
+
+	name := r.channelFile(channel)
+	// the metadata goes last so it never points at the build before the
+	// rest is in place
+	files := []struct {
+		name string
+		data string
+	}{
+		{name + "-true-timestamp", fmt.Sprintf("%d\n", r.TrueTimestamp)},
+		{name, r.metadata()},
+	}
+
+	if s.config.Remote() {
+		if err := s.startReleaseContainer(); err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			err := s.releaseExec([]string{"bash", "-c", `printf '%s' "$1" > "$2"`, "promote", f.data, path.Join("/release", f.name)})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range files {
+		target := path.Join(s.releasePath, f.name)
+		tmp := target + ".partial"
+
+		if err := ioutil.WriteFile(tmp, []byte(f.data), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", f.name, err)
+		}
+
+		// the OTA server may be reading the old file
+		if err := os.Rename(tmp, target); err != nil {
+			return fmt.Errorf("failed to write %s: %v", f.name, err)
+		}
+	}
+
+	log.Infof("%s channel of %s %s points at build %s", channel, r.Device, r.BuildVariant(), r.Build)
+
+	return nil
+}
+
+// PruneReleases removes the files of releases from the release directory,
+// and from the build host when building remotely.
+func (s *DockerStack) PruneReleases(releases []Release) error {
+	if len(releases) == 0 {
+		return nil
+	}
+
+	names := []string{}
+
+	for _, r := range releases {
+		for _, f := range r.Files {
+			names = append(names, f.Name)
+		}
+		// the index entry goes last, a failed prune is retried from it
+		names = append(names, r.indexFile())
+	}
+
+	if s.config.Remote() {
+		if err := s.pruneRemoteReleases(names); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		err := os.Remove(path.Join(s.releasePath, name))
+
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+
+		log.Infof("removed %s", name)
+	}
+
+	return nil
+}
+
+func (s *DockerStack) pruneRemoteReleases(names []string) error {
+	if err := s.startReleaseContainer(); err != nil {
+		return err
+	}
+
+	cmd := []string{"rm", "-f", "--"}
+
+	for _, name := range names {
+		cmd = append(cmd, path.Join("/release", name))
+	}
+
+	return s.releaseExec(cmd)
+}
+
+// startReleaseContainer starts the build container to change the release
+// volume of a remote build host. The container is stopped again on Shutdown.
+func (s *DockerStack) startReleaseContainer() error {
+	if detachedBuildRunning(s.config.StatePath, s.Name()) {
+		return fmt.Errorf("a detached build of %s is still running, see localstack status", s.Name())
+	}
+
+	return s.startContainer()
+}
+
+func (s *DockerStack) releaseExec(cmd []string) error {
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    cmd,
+		User:   "root",
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("failed to change the release volume of the build host, %s exited with %d", cmd[0], code)
+	}
+
+	return nil
+}
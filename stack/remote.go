@@ -0,0 +1,292 @@
+package stack
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	logsVolumeName = "localstack-logs"
+	// eventsMirrorPidFile holds the tail following the events of the build
+	// running in a container
+	eventsMirrorPidFile = "/tmp/localstack-events.pid"
+	mirrorEventsScript  = `echo $$ > "$2"; exec tail -n +1 -F "$1" 2>/dev/null`
+	// stopMirrorScript waits for the tail to record its pid, a build that
+	// fails right away can finish before it did
+	stopMirrorScript = `for i in 1 2 3 4 5; do [ -s "$1" ] && break; sleep 1; done; kill $(cat "$1") && rm -f "$1"`
+	// tarReleaseScript archives the release files named on stdin, each ended
+	// by a NUL and the list by an empty name, as podman never closes the
+	// stdin of an exec. The names can be too many for the argv of tar
+	tarReleaseScript = `list=$(mktemp) || exit 1; trap 'rm -f "${list}"' EXIT
+while IFS= read -r -d '' name && [ -n "${name}" ]; do printf '%s\0' "${name}"; done > "${list}"
+tar -C /release -cf - --null --verbatim-files-from -T "${list}"`
+)
+
+// Remote reports whether the build runs on another host, reached through an
+// ssh:// podman-url. The host paths of volumes are not accessible then, the
+// release and the build events are copied back through the container.
+func (c *DockerStackConfig) Remote() bool {
+	u, err := url.Parse(c.PodmanURL)
+
+	return err == nil && u.Scheme == "ssh"
+}
+
+// remoteFile is a file in the release directory of the build container.
+type remoteFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// fetchFile copies a single file out of the build container.
+func (s *DockerStack) fetchFile(src string, dest string) error {
+	f, err := os.Create(dest)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    []string{"cat", src},
+		Stdout: f,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("failed to read %s from build container", src)
+	}
+
+	return nil
+}
+
+// mirrorEvents follows the events file src of a build on the build host and
+// writes it to dest while the build runs, so progress and notifications are
+// reported as the steps finish. The returned function stops following.
+func (s *DockerStack) mirrorEvents(src string, dest string) (func(), error) {
+	f, err := os.Create(dest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+			Cmd:    []string{"bash", "-c", mirrorEventsScript, "mirror", src, eventsMirrorPidFile},
+			Stdout: f,
+			Stderr: os.Stderr,
+		})
+
+		if err != nil {
+			log.Warnf("failed to follow build events on build host: %v", err)
+		}
+	}()
+
+	return func() {
+		code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+			Cmd:    []string{"bash", "-c", stopMirrorScript, "stop", eventsMirrorPidFile},
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		})
+
+		if err == nil && code == 0 {
+			<-done
+		} else {
+			log.Warnf("failed to stop following build events on build host")
+		}
+
+		f.Close()
+	}, nil
+}
+
+func (s *DockerStack) listRelease() ([]remoteFile, error) {
+	out := &bytes.Buffer{}
+
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    []string{"find", "/release", "-type", "f", "-printf", `%P\t%s\t%T@\n`},
+		Stdout: out,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if code != 0 {
+		return nil, fmt.Errorf("failed to list release directory, find exited with %d", code)
+	}
+
+	files := []remoteFile{}
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.Split(line, "\t")
+
+		if len(fields) != 3 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("malformed release listing %q", line)
+		}
+
+		mtime, err := strconv.ParseFloat(fields[2], 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("malformed release listing %q", line)
+		}
+
+		files = append(files, remoteFile{
+			name:    fields[0],
+			size:    size,
+			modTime: time.Unix(int64(mtime), 0),
+		})
+	}
+
+	return files, nil
+}
+
+// syncRelease copies every release file that is missing or differs in size
+// or modification time from the build container to releasePath.
+func (s *DockerStack) syncRelease() error {
+	files, err := s.listRelease()
+
+	if err != nil {
+		return err
+	}
+
+	changed := []string{}
+
+	for _, f := range files {
+		info, err := os.Stat(path.Join(s.releasePath, f.name))
+
+		if err == nil && info.Size() == f.size && info.ModTime().Unix() == f.modTime.Unix() {
+			continue
+		}
+
+		changed = append(changed, f.name)
+	}
+
+	if len(changed) == 0 {
+		log.Info("release directory is up to date")
+		return nil
+	}
+
+	log.Infof("copying %d release files from build host", len(changed))
+
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+
+	go func() {
+		code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+			Cmd:    []string{"bash", "-c", tarReleaseScript},
+			Stdin:  strings.NewReader(strings.Join(changed, "\x00") + "\x00\x00"),
+			Stdout: pw,
+			Stderr: os.Stderr,
+		})
+
+		if err == nil && code != 0 {
+			err = fmt.Errorf("tar exited with %d", code)
+		}
+
+		pw.CloseWithError(err)
+		result <- err
+	}()
+
+	err = extractRelease(pr, s.releasePath)
+
+	// drain the stream so the exec can finish if extracting failed
+	io.Copy(ioutil.Discard, pr)
+
+	if execErr := <-result; execErr != nil {
+		return fmt.Errorf("failed to copy release: %v", execErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to copy release: %v", err)
+	}
+
+	return nil
+}
+
+func extractRelease(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.Clean(header.Name)
+
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("refusing to extract %s", header.Name)
+		}
+
+		target := path.Join(dir, name)
+
+		if err := os.MkdirAll(path.Dir(target), 0700); err != nil {
+			return err
+		}
+
+		// write next to the old file so a failed copy never leaves a
+		// truncated release behind
+		tmp := target + ".partial"
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, tr)
+
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+
+		if err := os.Chtimes(tmp, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmp, target); err != nil {
+			return err
+		}
+	}
+}
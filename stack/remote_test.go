@@ -0,0 +1,174 @@
+package stack
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// remoteTestStack connects to the podman service named by
+// LOCALSTACK_TEST_PODMAN_URL, e.g. a container running sshd and podman
+// reached as ssh://root@localhost:2222/run/podman/podman.sock, and starts a
+// build container there. LOCALSTACK_TEST_SSH_KEY is the key to log in with
+// and LOCALSTACK_TEST_IMAGE an image on that host with bash, find and tar,
+// the build image by default.
+func remoteTestStack(t *testing.T) *DockerStack {
+	url := os.Getenv("LOCALSTACK_TEST_PODMAN_URL")
+
+	if url == "" {
+		t.Skip("LOCALSTACK_TEST_PODMAN_URL is not set")
+	}
+
+	image := os.Getenv("LOCALSTACK_TEST_IMAGE")
+
+	if image == "" {
+		image = imageTag
+	}
+
+	runtime, err := newPodmanRuntime(url, os.Getenv("LOCALSTACK_TEST_SSH_KEY"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { runtime.Close() })
+
+	releasePath, err := ioutil.TempDir("", "localstack-release")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(releasePath) })
+
+	s := &DockerStack{
+		config: &DockerStackConfig{
+			Device:    "test",
+			PodmanURL: url,
+		},
+		profile:     &Profile{Name: "remote-test"},
+		runtime:     runtime,
+		releasePath: releasePath,
+	}
+
+	if !s.config.Remote() {
+		t.Fatalf("%s is not an ssh url", url)
+	}
+
+	if s.containerExists() {
+		runtime.RemoveContainer(s.containerName(), true)
+	}
+
+	err = runtime.RunContainer(&ContainerSpec{
+		Name:     s.containerName(),
+		Image:    image,
+		Terminal: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { runtime.RemoveContainer(s.containerName(), true) })
+
+	return s
+}
+
+func remoteExec(t *testing.T, s *DockerStack, script string) {
+	code, err := s.runtime.Exec(s.containerName(), &ExecSpec{
+		Cmd:    []string{"bash", "-c", script},
+		User:   "root",
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 0 {
+		t.Fatalf("%q exited with %d", script, code)
+	}
+}
+
+func checkReleaseFile(t *testing.T, s *DockerStack, name string, want string) {
+	got, err := ioutil.ReadFile(path.Join(s.releasePath, name))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+func TestSyncRelease(t *testing.T) {
+	s := remoteTestStack(t)
+
+	remoteExec(t, s, `mkdir -p /release/crosshatch/user &&
+		echo 1 > /release/crosshatch-stable &&
+		echo ota > /release/crosshatch/user/crosshatch-ota_update-1.zip &&
+		echo odd > "/release/-odd name"`)
+
+	if err := s.syncRelease(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReleaseFile(t, s, "crosshatch-stable", "1\n")
+	checkReleaseFile(t, s, "-odd name", "odd\n")
+	checkReleaseFile(t, s, "crosshatch/user/crosshatch-ota_update-1.zip", "ota\n")
+
+	local := path.Join(s.releasePath, "crosshatch-stable")
+	info, err := os.Stat(local)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a local file of the same size and time is up to date and must not be
+	// copied again
+	if err := ioutil.WriteFile(local, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(local, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteExec(t, s, `echo ota-2 > /release/crosshatch/user/crosshatch-ota_update-1.zip &&
+		echo ota > /release/crosshatch/user/crosshatch-ota_update-2.zip`)
+
+	if err := s.syncRelease(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReleaseFile(t, s, "crosshatch-stable", "x\n")
+	checkReleaseFile(t, s, "crosshatch/user/crosshatch-ota_update-1.zip", "ota-2\n")
+	checkReleaseFile(t, s, "crosshatch/user/crosshatch-ota_update-2.zip", "ota\n")
+}
+
+func TestMirrorEvents(t *testing.T) {
+	s := remoteTestStack(t)
+	dest := path.Join(s.releasePath, "build"+eventsSuffix)
+
+	stop, err := s.mirrorEvents("/tmp/build"+eventsSuffix, dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remoteExec(t, s, `echo "1 start setup_env" >> /tmp/build.events`)
+	time.Sleep(3 * time.Second)
+
+	// the event has to be mirrored while the build is still running
+	checkReleaseFile(t, s, "build"+eventsSuffix, "1 start setup_env\n")
+
+	remoteExec(t, s, `echo "2 end setup_env" >> /tmp/build.events`)
+	time.Sleep(3 * time.Second)
+	stop()
+
+	checkReleaseFile(t, s, "build"+eventsSuffix, "1 start setup_env\n2 end setup_env\n")
+}
@@ -0,0 +1,105 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Runtime is the container engine the stack builds its images with and runs
+// the build in.
+type Runtime interface {
+	// BuildImage builds the Dockerfile in contextDir and tags the result,
+	// giving up once ctx is cancelled
+	BuildImage(ctx context.Context, contextDir string, tag string) error
+	// EnsureVolume creates the named volume unless it exists
+	EnsureVolume(name string) error
+	// WithVolume runs fn on a host directory holding the files of a volume.
+	// fn may only change them if write is set
+	WithVolume(name string, write bool, fn func(dir string) error) error
+	ContainerExists(name string) bool
+	// RunContainer creates and starts a container and waits for it to run
+	RunContainer(spec *ContainerSpec) error
+	StopContainer(name string, timeout uint) error
+	RemoveContainer(name string, force bool) error
+	// Exec runs a command in a running container until it exits and
+	// returns its exit code
+	Exec(container string, spec *ExecSpec) (int, error)
+	// Close disconnects from the engine, stopping it if the runtime
+	// started it
+	Close() error
+}
+
+const (
+	MountVolume = "volume"
+	MountBind   = "bind"
+	MountTmpfs  = "tmpfs"
+)
+
+// Mount is a volume, bind mount or tmpfs of a container.
+type Mount struct {
+	Type        string
+	Source      string
+	Destination string
+	ReadOnly    bool
+	// TmpfsSize and TmpfsMode only apply to tmpfs mounts, which are always
+	// nosuid, nodev and noexec
+	TmpfsSize int64
+	TmpfsMode os.FileMode
+}
+
+// PortMapping publishes a container port on the host.
+type PortMapping struct {
+	HostPort      uint16
+	ContainerPort uint16
+}
+
+// Resources limits the resources of a container, zero is unlimited.
+type Resources struct {
+	CPUs int
+	// Memory is in bytes
+	Memory int64
+	// Swap is the swap in bytes the container may use on top of Memory, it
+	// only applies if Memory is limited
+	Swap int64
+	Pids int64
+}
+
+// ContainerSpec describes a container independent of the runtime.
+type ContainerSpec struct {
+	Name      string
+	Image     string
+	Terminal  bool
+	Env       map[string]string
+	Mounts    []Mount
+	Ports     []PortMapping
+	Resources Resources
+}
+
+// ExecSpec is a command run in a container. Stdin may be nil.
+type ExecSpec struct {
+	Cmd []string
+	Env []string
+	// User defaults to the user of the image
+	User   string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Runtimes lists the values of the runtime config key.
+var Runtimes = []string{"podman", "docker"}
+
+// NewRuntime connects to the container engine selected by the runtime
+// config key, podman if it is empty.
+func NewRuntime(config *DockerStackConfig) (Runtime, error) {
+	switch config.Runtime {
+	case "", "podman":
+		return newPodmanRuntime(config.PodmanURL, config.SSHKey)
+	case "docker":
+		return newDockerRuntime()
+	}
+
+	return nil, fmt.Errorf("unknown runtime %s, expected one of %v", config.Runtime, Runtimes)
+}
@@ -0,0 +1,53 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// latestJSONURL is the same version manifest the build script consults in
+// get_latest_versions.
+const latestJSONURL = "https://raw.githubusercontent.com/RattlesnakeOS/latest/11.0/latest.json"
+
+type latestVersions struct {
+	Devices map[string]struct {
+		BuildID string `json:"build_id"`
+		AOSPTag string `json:"aosp_tag"`
+	} `json:"devices"`
+}
+
+// LatestVendorBuild returns the AOSP build id the upstream vendor files for
+// device are currently published for.
+func LatestVendorBuild(device string) (string, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Get(latestJSONURL)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch latest versions: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch latest versions: %s", resp.Status)
+	}
+
+	versions := latestVersions{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+		return "", fmt.Errorf("failed to parse latest versions: %v", err)
+	}
+
+	d, ok := versions.Devices[device]
+
+	if !ok || d.BuildID == "" {
+		return "", fmt.Errorf("no vendor build published for %s", device)
+	}
+
+	return d.BuildID, nil
+}